@@ -0,0 +1,99 @@
+package awsecs
+
+import (
+	"context"
+	stderrors "errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/TouchBistro/gehen/config"
+	"github.com/TouchBistro/goutils/color"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/pkg/errors"
+)
+
+// ErrAlarm indicates that a CloudWatch alarm of a service went into the ALARM state.
+var ErrAlarm = stderrors.New("alarm triggered")
+
+type CWClient interface {
+	DescribeAlarms(ctx context.Context, params *cloudwatch.DescribeAlarmsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.DescribeAlarmsOutput, error)
+}
+
+// alarmState is the state of a metric or composite alarm.
+type alarmState struct {
+	value     cwtypes.StateValue
+	reason    string
+	updatedAt time.Time
+}
+
+// CheckAlarms checks the CloudWatch alarms of the service. If any of them went into the
+// ALARM state after since, the returned error will wrap ErrAlarm. Alarms that were already
+// in the ALARM state before since are only logged since the deploy didn't cause them.
+func CheckAlarms(ctx context.Context, service *config.Service, since time.Time, cwClient CWClient) error {
+	if len(service.Alarms) == 0 {
+		return nil
+	}
+
+	states, err := describeAlarms(ctx, service.Alarms, cwClient)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get alarms for service: %s", service.Name)
+	}
+
+	var missing []string
+	for _, name := range service.Alarms {
+		state, ok := states[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		if state.value != cwtypes.StateValueAlarm {
+			continue
+		}
+		if state.updatedAt.Before(since) {
+			log.Printf("Alarm %s of %s was already in the ALARM state before the deploy\n", color.Yellow(name), color.Cyan(service.Name))
+			continue
+		}
+		return errors.Wrapf(ErrAlarm, "alarm %s: %s", name, state.reason)
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("alarms not found for service %s: %s", service.Name, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// describeAlarms returns the state of the given alarms by name.
+func describeAlarms(ctx context.Context, names []string, cwClient CWClient) (map[string]alarmState, error) {
+	states := make(map[string]alarmState)
+	input := &cloudwatch.DescribeAlarmsInput{
+		AlarmNames: names,
+		AlarmTypes: []cwtypes.AlarmType{cwtypes.AlarmTypeMetricAlarm, cwtypes.AlarmTypeCompositeAlarm},
+	}
+	for {
+		resp, err := cwClient.DescribeAlarms(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range resp.MetricAlarms {
+			states[aws.ToString(a.AlarmName)] = alarmState{
+				value:     a.StateValue,
+				reason:    aws.ToString(a.StateReason),
+				updatedAt: aws.ToTime(a.StateUpdatedTimestamp),
+			}
+		}
+		for _, a := range resp.CompositeAlarms {
+			states[aws.ToString(a.AlarmName)] = alarmState{
+				value:     a.StateValue,
+				reason:    aws.ToString(a.StateReason),
+				updatedAt: aws.ToTime(a.StateUpdatedTimestamp),
+			}
+		}
+
+		if resp.NextToken == nil {
+			return states, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
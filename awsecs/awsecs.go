@@ -5,11 +5,11 @@ import (
 	stderrors "errors"
 	"fmt"
 	"log"
-	"regexp"
 	"strings"
 
 	"github.com/TouchBistro/gehen/config"
 	"github.com/TouchBistro/goutils/color"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
@@ -26,10 +26,13 @@ type ECSClient interface {
 	DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error)
 	DescribeTaskDefinition(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error)
 	RegisterTaskDefinition(ctx context.Context, params *ecs.RegisterTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.RegisterTaskDefinitionOutput, error)
+	ListTaskDefinitions(ctx context.Context, params *ecs.ListTaskDefinitionsInput, optFns ...func(*ecs.Options)) (*ecs.ListTaskDefinitionsOutput, error)
+	DescribeContainerInstances(ctx context.Context, params *ecs.DescribeContainerInstancesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeContainerInstancesOutput, error)
 }
 
 // Deploy registers a new task for the given service in ECS in order to create a new deployment.
-func Deploy(ctx context.Context, service *config.Service, ecsClient ECSClient) error {
+// Services using the CODE_DEPLOY deployment controller are deployed with CodeDeploy.
+func Deploy(ctx context.Context, service *config.Service, ecsClient ECSClient, cdClient CDClient) error {
 	// Ensure we've been passed a valid cluster ARN and exit if not
 	clusterArn, err := arn.Parse(service.Cluster)
 	if err != nil {
@@ -47,7 +50,8 @@ func Deploy(ctx context.Context, service *config.Service, ecsClient ECSClient) e
 		return errors.Wrapf(err, "failed to find service: %s", service.Name)
 	}
 
-	taskDefARN := *respDescribeServices.Services[0].TaskDefinition
+	awsService := respDescribeServices.Services[0]
+	taskDefARN := *awsService.TaskDefinition
 	log.Printf("Found current task definition: %v\n", taskDefARN)
 
 	updateTaskDefRes, err := updateTaskDef(ctx, taskDefARN, service.Gitsha, service.UpdateStrategy, service.Containers, ecsClient)
@@ -62,14 +66,40 @@ func Deploy(ctx context.Context, service *config.Service, ecsClient ECSClient) e
 	service.PreviousTaskDefinitionARN = taskDefARN
 	service.TaskDefinitionARN = updateTaskDefRes.newTaskDefARN
 	service.Tags = updateTaskDefRes.dockerTags
-	if err := UpdateService(ctx, service, ecsClient); err != nil {
+	if err := updateService(ctx, service, awsService, ecsClient, cdClient); err != nil {
 		return errors.Wrap(err, "failed to update service")
 	}
 	return nil
 }
 
-// UpdateService creates a new deployment on ECS.
-func UpdateService(ctx context.Context, service *config.Service, ecsClient ECSClient) error {
+// UpdateService creates a new deployment on ECS. Services using the CODE_DEPLOY
+// deployment controller are deployed with CodeDeploy, see updateCodeDeployService.
+// If the deployment circuit breaker already rolled back the service to
+// service.TaskDefinitionARN no new deployment is created.
+func UpdateService(ctx context.Context, service *config.Service, ecsClient ECSClient, cdClient CDClient) error {
+	respDescribeServices, err := ecsClient.DescribeServices(ctx, &ecs.DescribeServicesInput{
+		Services: []string{service.Name},
+		Cluster:  &service.Cluster,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to find service: %s", service.Name)
+	}
+	if len(respDescribeServices.Services) != 1 {
+		return errors.Errorf("expected 1 service named %s, got %d", service.Name, len(respDescribeServices.Services))
+	}
+	awsService := respDescribeServices.Services[0]
+	if rolledBackByECS(awsService, service.TaskDefinitionARN) {
+		log.Printf("ECS already rolled back %s to %s\n", color.Cyan(service.Name), service.TaskDefinitionARN)
+		return nil
+	}
+	return updateService(ctx, service, awsService, ecsClient, cdClient)
+}
+
+func updateService(ctx context.Context, service *config.Service, awsService ecstypes.Service, ecsClient ECSClient, cdClient CDClient) error {
+	if usesCodeDeploy(awsService) {
+		return updateCodeDeployService(ctx, service, awsService, cdClient)
+	}
+
 	_, err := ecsClient.UpdateService(ctx, &ecs.UpdateServiceInput{
 		TaskDefinition:     &service.TaskDefinitionARN,
 		Service:            &service.Name,
@@ -84,7 +114,12 @@ func UpdateService(ctx context.Context, service *config.Service, ecsClient ECSCl
 
 // CheckDrain checks if all old tasks have drained. If the tasks are failing healthchecks,
 // the return error will wrap ErrHealthcheckFailed.
-func CheckDrain(ctx context.Context, service *config.Service, ecsClient ECSClient) (bool, error) {
+// If the service is behind a load balancer, the targets of the new tasks must also be healthy
+// and the targets of the old tasks deregistered, see CheckTargetHealth.
+// If the ECS deployment circuit breaker marked the deployment as failed, the returned error
+// will wrap ErrDeploymentFailed. Services deployed by CodeDeploy are checked using their
+// deployment, if it failed the returned error will wrap ErrCodeDeployFailed.
+func CheckDrain(ctx context.Context, service *config.Service, ecsClient ECSClient, elbClient ELBClient, cdClient CDClient) (bool, error) {
 	respDescribeServices, err := ecsClient.DescribeServices(ctx, &ecs.DescribeServicesInput{
 		Services: []string{service.Name},
 		Cluster:  &service.Cluster,
@@ -97,58 +132,112 @@ func CheckDrain(ctx context.Context, service *config.Service, ecsClient ECSClien
 		for _, f := range respDescribeServices.Failures {
 			writeFailure(&sb, f)
 		}
-		return false, errors.Wrapf(err, "failed to get service: %s", sb.String())
+		return false, errors.Errorf("failed to get service: %s", sb.String())
 	}
 	if len(respDescribeServices.Services) != 1 {
-		return false, errors.Wrapf(err, "expected 1 service named %s, got %d", service.Name, len(respDescribeServices.Services))
+		return false, errors.Errorf("expected 1 service named %s, got %d", service.Name, len(respDescribeServices.Services))
 	}
 
 	awsService := respDescribeServices.Services[0]
-	for _, deployment := range awsService.Deployments {
-		expectedTaskDefARN := service.TaskDefinitionARN
-		if expectedTaskDefARN == "" {
-			// If no task def arn set for the service, fallback to the one present on AWS
-			// this should work since that is set by calls to UpdateService, so it should be
-			// the desired one for new deploys
-			expectedTaskDefARN = *awsService.TaskDefinition
+	expectedTaskDefARN := service.TaskDefinitionARN
+	if expectedTaskDefARN == "" {
+		// If no task def arn set for the service, fallback to the one present on AWS
+		// this should work since that is set by calls to UpdateService, so it should be
+		// the desired one for new deploys
+		expectedTaskDefARN = *awsService.TaskDefinition
+	}
+	if usesCodeDeploy(awsService) {
+		drained, err := checkCodeDeployDrain(ctx, service, awsService, expectedTaskDefARN, cdClient)
+		if drained || err != nil {
+			return drained, err
 		}
+		return false, checkTaskHealth(ctx, service, "", ecsClient)
+	}
 
-		if (*deployment.TaskDefinition == expectedTaskDefARN) && (*deployment.Status == "PRIMARY") && (deployment.RunningCount == deployment.DesiredCount) {
-			return true, nil
+	if deployment := newestDeployment(awsService, expectedTaskDefARN); deployment != nil {
+		// No point waiting if the circuit breaker already gave up on the deployment
+		if deployment.RolloutState == ecstypes.DeploymentRolloutStateFailed {
+			return false, deploymentFailedError(awsService, *deployment)
+		}
+		if (*deployment.Status == "PRIMARY") && (deployment.RunningCount == deployment.DesiredCount) {
+			if len(awsService.LoadBalancers) == 0 {
+				return true, nil
+			}
+			return CheckTargetHealth(ctx, service, expectedTaskDefARN, awsService.LoadBalancers, ecsClient, elbClient)
 		}
 	}
 
 	// Check and see if container healthchecks failed so we can provide more details
+	return false, checkTaskHealth(ctx, service, "", ecsClient)
+}
 
-	// TODO(@cszatmary): The response could be paginated, may need to handle this in the future
-	respListTasks, err := ecsClient.ListTasks(ctx, &ecs.ListTasksInput{
-		Cluster:     &service.Cluster,
-		ServiceName: &service.Name,
-	})
+// CheckHealth checks the container health checks of the running tasks of the service that use
+// service.TaskDefinitionARN. If any of the tasks are unhealthy the returned error will wrap ErrHealthcheckFailed.
+func CheckHealth(ctx context.Context, service *config.Service, ecsClient ECSClient) error {
+	return checkTaskHealth(ctx, service, ecstypes.DesiredStatusRunning, ecsClient)
+}
+
+// checkTaskHealth checks the health of the service's tasks with the given desired status, see CheckHealth.
+func checkTaskHealth(ctx context.Context, service *config.Service, desiredStatus ecstypes.DesiredStatus, ecsClient ECSClient) error {
+	tasks, err := describeServiceTasks(ctx, service, desiredStatus, ecsClient)
 	if err != nil {
-		return false, errors.Wrapf(err, "failed to list tasks for service: %s", service.Name)
+		return err
 	}
-	respDescribeTasks, err := ecsClient.DescribeTasks(ctx, &ecs.DescribeTasksInput{
-		Cluster: &service.Cluster,
-		Tasks:   respListTasks.TaskArns,
-	})
-	if err != nil {
-		return false, errors.Wrapf(err, "failed to get tasks for service: %s", service.Name)
+	for _, task := range tasks {
+		if task.HealthStatus == ecstypes.HealthStatusUnhealthy && *task.TaskDefinitionArn == service.TaskDefinitionARN {
+			return errors.Wrapf(ErrHealthcheckFailed, "task %s is unhealthy", *task.TaskArn)
+		}
 	}
-	if len(respDescribeTasks.Failures) > 0 {
-		var sb strings.Builder
-		for _, f := range respDescribeServices.Failures {
-			writeFailure(&sb, f)
+	return nil
+}
+
+// maxDescribeTasks is the maximum number of tasks DescribeTasks accepts in one call.
+const maxDescribeTasks = 100
+
+// describeServiceTasks returns the tasks of the service. If desiredStatus is set,
+// only tasks with that desired status are returned.
+func describeServiceTasks(ctx context.Context, service *config.Service, desiredStatus ecstypes.DesiredStatus, ecsClient ECSClient) ([]ecstypes.Task, error) {
+	var taskARNs []string
+	input := &ecs.ListTasksInput{
+		Cluster:       &service.Cluster,
+		ServiceName:   &service.Name,
+		DesiredStatus: desiredStatus,
+	}
+	for {
+		respListTasks, err := ecsClient.ListTasks(ctx, input)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list tasks for service: %s", service.Name)
+		}
+		taskARNs = append(taskARNs, respListTasks.TaskArns...)
+		if respListTasks.NextToken == nil {
+			break
 		}
-		return false, errors.Wrapf(err, "failed to get tasks: %s", sb.String())
+		input.NextToken = respListTasks.NextToken
 	}
 
-	for _, task := range respDescribeTasks.Tasks {
-		if task.HealthStatus == ecstypes.HealthStatusUnhealthy && *task.TaskDefinitionArn == service.TaskDefinitionARN {
-			return false, errors.Wrapf(ErrHealthcheckFailed, "task %s is unhealthy", *task.TaskArn)
+	var tasks []ecstypes.Task
+	for start := 0; start < len(taskARNs); start += maxDescribeTasks {
+		end := start + maxDescribeTasks
+		if end > len(taskARNs) {
+			end = len(taskARNs)
 		}
+		respDescribeTasks, err := ecsClient.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+			Cluster: &service.Cluster,
+			Tasks:   taskARNs[start:end],
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get tasks for service: %s", service.Name)
+		}
+		if len(respDescribeTasks.Failures) > 0 {
+			var sb strings.Builder
+			for _, f := range respDescribeTasks.Failures {
+				writeFailure(&sb, f)
+			}
+			return nil, errors.Errorf("failed to get tasks: %s", sb.String())
+		}
+		tasks = append(tasks, respDescribeTasks.Tasks...)
 	}
-	return false, nil
+	return tasks, nil
 }
 
 type updateTaskDefResult struct {
@@ -160,81 +249,9 @@ type updateTaskDefResult struct {
 // updateTaskDef creates a new task def revision with the container image updated to use the new Git SHA.
 // It returns the new ARN and previous Git SHA.
 func updateTaskDef(ctx context.Context, taskDefARN, gitsha, updateStrategy string, containers []string, ecsClient ECSClient) (updateTaskDefResult, error) {
-	taskDefName := taskDefARN
-	if updateStrategy == config.UpdateStrategyLatest {
-		// If latest parse the family name from the ARN so we can look up the latest revision
-		// parse arn for family name
-		r := regexp.MustCompile(`arn:aws:ecs:[^:\n]*:[^:\n]*:task-definition\/([^:\n]*):\d+`)
-		matches := r.FindStringSubmatch(taskDefARN)
-		if matches == nil {
-			return updateTaskDefResult{}, errors.Errorf("unable to parse task def family: %s", taskDefARN)
-		}
-		taskDefName = matches[1]
-	}
-
-	// Use resolved resource info to grab existing task def
-	respDescribeTaskDef, err := ecsClient.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
-		TaskDefinition: &taskDefName,
-	})
+	plan, newTaskInput, err := planTaskDef(ctx, taskDefARN, gitsha, updateStrategy, containers, ecsClient)
 	if err != nil {
-		return updateTaskDefResult{}, errors.Wrapf(err, "failed to get task definition: %s", taskDefName)
-	}
-
-	// Convert API output to be ready to update task.
-	taskDef := respDescribeTaskDef.TaskDefinition
-	newTaskInput := ecs.RegisterTaskDefinitionInput{
-		ContainerDefinitions:    taskDef.ContainerDefinitions,
-		Cpu:                     taskDef.Cpu,
-		ExecutionRoleArn:        taskDef.ExecutionRoleArn,
-		Family:                  taskDef.Family,
-		IpcMode:                 taskDef.IpcMode,
-		Memory:                  taskDef.Memory,
-		NetworkMode:             taskDef.NetworkMode,
-		PidMode:                 taskDef.PidMode,
-		PlacementConstraints:    taskDef.PlacementConstraints,
-		ProxyConfiguration:      taskDef.ProxyConfiguration,
-		RequiresCompatibilities: taskDef.RequiresCompatibilities,
-		TaskRoleArn:             taskDef.TaskRoleArn,
-		Volumes:                 taskDef.Volumes,
-	}
-
-	previousGitsha := ""
-	shouldUpdate := false
-
-	containersToUpdate := make(map[string]bool)
-	for _, c := range containers {
-		containersToUpdate[c] = true
-	}
-
-	// Update desired containers in task def to use same repo with new tag/sha
-	for i, containerDef := range newTaskInput.ContainerDefinitions {
-		// If service config does not specify which containers to update, we update all containers
-		// in that task def.
-		if len(containersToUpdate) != 0 {
-			if found := containersToUpdate[*containerDef.Name]; !found {
-				continue
-			}
-		}
-
-		// Images have the form <repo-url>/<image>:<tag>
-		t := strings.Split(*containerDef.Image, ":")
-
-		if previousGitsha == "" {
-			// Tag is the last element which is the SHA
-			previousGitsha = t[len(t)-1]
-		}
-
-		// Only update if we find an existing image that is different from the new gitsha
-		if gitsha == previousGitsha || updateStrategy == config.UpdateStrategyRedeploy {
-			continue
-		}
-
-		shouldUpdate = true
-
-		// Get new image by using new SHA
-		newImage := fmt.Sprintf("%s:%s", strings.Join(t[:len(t)-1], ""), gitsha)
-		log.Printf("Changing container image %s to %s", color.Cyan(*containerDef.Image), color.Cyan(newImage))
-		*newTaskInput.ContainerDefinitions[i].Image = newImage
+		return updateTaskDefResult{}, err
 	}
 
 	dockerTags := newTaskInput.ContainerDefinitions[0].DockerLabels
@@ -248,15 +265,24 @@ func updateTaskDef(ctx context.Context, taskDefARN, gitsha, updateStrategy strin
 		tags = append(tags, newTag)
 	}
 
-	if !shouldUpdate {
+	if !plan.NewRevision {
 		return updateTaskDefResult{
 			// This might still be different if UpdateStrategyLatest was used
-			newTaskDefARN:  *taskDef.TaskDefinitionArn,
-			previousGitsha: previousGitsha,
+			newTaskDefARN:  plan.BaseTaskDefinitionARN,
+			previousGitsha: plan.PreviousGitsha,
 			dockerTags:     tags,
 		}, nil
 	}
 
+	// Update desired containers in task def to use same repo with new tag/sha
+	for i, c := range plan.Containers {
+		if c.NewImage == c.Image {
+			continue
+		}
+		log.Printf("Changing container image %s to %s", color.Cyan(c.Image), color.Cyan(c.NewImage))
+		newTaskInput.ContainerDefinitions[i].Image = aws.String(c.NewImage)
+	}
+
 	// Create new task def so we can update service to use it
 	respRegisterTaskDef, err := ecsClient.RegisterTaskDefinition(ctx, &newTaskInput)
 	if err != nil {
@@ -268,7 +294,7 @@ func updateTaskDef(ctx context.Context, taskDefARN, gitsha, updateStrategy strin
 
 	return updateTaskDefResult{
 		newTaskDefARN:  newTaskDefArn,
-		previousGitsha: previousGitsha,
+		previousGitsha: plan.PreviousGitsha,
 		dockerTags:     tags,
 	}, nil
 }
@@ -94,3 +94,24 @@ func UpdateScheduledTask(ctx context.Context, args UpdateScheduledTaskArgs) erro
 
 	return nil
 }
+
+// PlanScheduledTask determines the changes UpdateScheduledTask would make to the task definition
+// of the scheduled task without registering a new task definition or updating the targets.
+func PlanScheduledTask(ctx context.Context, task *config.ScheduledTask, ebClient EBClient, ecsClient ECSClient) (TaskDefPlan, error) {
+	respListTargets, err := ebClient.ListTargetsByRule(ctx, &eventbridge.ListTargetsByRuleInput{
+		Rule: &task.Name,
+	})
+	if err != nil {
+		return TaskDefPlan{}, errors.Wrapf(err, "failed to find eventbridge rule for scheduled task %s", task.Name)
+	}
+	if len(respListTargets.Targets) != 1 {
+		return TaskDefPlan{}, errors.Errorf("expected 1 target for scheduled task rule, found %d", len(respListTargets.Targets))
+	}
+
+	taskDefARN := *respListTargets.Targets[0].EcsParameters.TaskDefinitionArn
+	plan, _, err := planTaskDef(ctx, taskDefARN, task.Gitsha, task.UpdateStrategy, []string{}, ecsClient)
+	if err != nil {
+		return TaskDefPlan{}, errors.Wrapf(err, "failed to plan task def for scheduled task: %s", task.Name)
+	}
+	return plan, nil
+}
@@ -0,0 +1,58 @@
+package awsecs
+
+import (
+	stderrors "errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/pkg/errors"
+)
+
+// ErrDeploymentFailed indicates that the ECS deployment circuit breaker marked the deployment of a service as failed.
+var ErrDeploymentFailed = stderrors.New("deployment failed")
+
+// newestDeployment returns the most recently created deployment of the service using taskDefARN.
+// It returns nil if there is none.
+func newestDeployment(awsService ecstypes.Service, taskDefARN string) *ecstypes.Deployment {
+	var newest *ecstypes.Deployment
+	for i, d := range awsService.Deployments {
+		if aws.ToString(d.TaskDefinition) != taskDefARN {
+			continue
+		}
+		if newest == nil || aws.ToTime(d.CreatedAt).After(aws.ToTime(newest.CreatedAt)) {
+			newest = &awsService.Deployments[i]
+		}
+	}
+	return newest
+}
+
+// deploymentFailedError returns an error wrapping ErrDeploymentFailed for the failed deployment.
+// If the circuit breaker is rolling back the service the error says which task definition it is rolling back to.
+func deploymentFailedError(awsService ecstypes.Service, deployment ecstypes.Deployment) error {
+	reason := aws.ToString(deployment.RolloutStateReason)
+	if reason == "" {
+		reason = "no reason given"
+	}
+	for _, d := range awsService.Deployments {
+		if aws.ToString(d.Status) == "PRIMARY" && aws.ToString(d.TaskDefinition) != aws.ToString(deployment.TaskDefinition) {
+			return errors.Wrapf(ErrDeploymentFailed, "deployment %s: %s, ECS is rolling back to %s", aws.ToString(deployment.Id), reason, aws.ToString(d.TaskDefinition))
+		}
+	}
+	return errors.Wrapf(ErrDeploymentFailed, "deployment %s: %s", aws.ToString(deployment.Id), reason)
+}
+
+// rolledBackByECS reports whether the deployment circuit breaker already rolled back the service to taskDefARN,
+// in which case the primary deployment uses taskDefARN and a newer deployment has failed.
+func rolledBackByECS(awsService ecstypes.Service, taskDefARN string) bool {
+	primaryTaskDef := ""
+	failed := false
+	for _, d := range awsService.Deployments {
+		if aws.ToString(d.Status) == "PRIMARY" {
+			primaryTaskDef = aws.ToString(d.TaskDefinition)
+		}
+		if d.RolloutState == ecstypes.DeploymentRolloutStateFailed {
+			failed = true
+		}
+	}
+	return failed && primaryTaskDef == taskDefARN
+}
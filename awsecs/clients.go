@@ -0,0 +1,206 @@
+package awsecs
+
+import (
+	"sync"
+
+	"github.com/TouchBistro/gehen/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// ECSClientProvider provides an ECSClient for a given AWS region and IAM role.
+type ECSClientProvider interface {
+	ECSClient(region string, role *config.Role) ECSClient
+}
+
+// EBClientProvider provides an EBClient for a given AWS region and IAM role.
+type EBClientProvider interface {
+	EBClient(region string, role *config.Role) EBClient
+}
+
+// ELBClientProvider provides an ELBClient for a given AWS region and IAM role.
+type ELBClientProvider interface {
+	ELBClient(region string, role *config.Role) ELBClient
+}
+
+// CWClientProvider provides a CWClient for a given AWS region and IAM role.
+type CWClientProvider interface {
+	CWClient(region string, role *config.Role) CWClient
+}
+
+// CDClientProvider provides a CDClient for a given AWS region and IAM role.
+type CDClientProvider interface {
+	CDClient(region string, role *config.Role) CDClient
+}
+
+// LogsClientProvider provides a LogsClient for a given AWS region and IAM role.
+type LogsClientProvider interface {
+	LogsClient(region string, role *config.Role) LogsClient
+}
+
+// clientKey uniquely identifies the region and role a client was created for.
+type clientKey struct {
+	region string
+	role   config.Role
+}
+
+// Clients creates AWS clients on demand and caches them by region and role.
+// It is safe for concurrent use.
+type Clients struct {
+	cfg         aws.Config
+	mu          sync.Mutex
+	credentials map[config.Role]aws.CredentialsProvider
+	ecsClients  map[clientKey]*ecs.Client
+	ebClients   map[clientKey]*eventbridge.Client
+	elbClients  map[clientKey]*elb.Client
+	cwClients   map[clientKey]*cloudwatch.Client
+	cdClients   map[clientKey]*codedeploy.Client
+	logsClients map[clientKey]*cloudwatchlogs.Client
+}
+
+// NewClients returns a Clients instance that creates clients using cfg.
+// The region of cfg is used if an empty region is requested and
+// the credentials of cfg are used if no role is provided.
+func NewClients(cfg aws.Config) *Clients {
+	return &Clients{
+		cfg:         cfg,
+		credentials: make(map[config.Role]aws.CredentialsProvider),
+		ecsClients:  make(map[clientKey]*ecs.Client),
+		ebClients:   make(map[clientKey]*eventbridge.Client),
+		elbClients:  make(map[clientKey]*elb.Client),
+		cwClients:   make(map[clientKey]*cloudwatch.Client),
+		cdClients:   make(map[clientKey]*codedeploy.Client),
+		logsClients: make(map[clientKey]*cloudwatchlogs.Client),
+	}
+}
+
+// ECSClient returns the ECS client for the given region and role.
+func (c *Clients) ECSClient(region string, role *config.Role) ECSClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := c.key(region, role)
+	client, ok := c.ecsClients[key]
+	if !ok {
+		client = ecs.NewFromConfig(c.configFor(key))
+		c.ecsClients[key] = client
+	}
+	return client
+}
+
+// EBClient returns the EventBridge client for the given region and role.
+func (c *Clients) EBClient(region string, role *config.Role) EBClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := c.key(region, role)
+	client, ok := c.ebClients[key]
+	if !ok {
+		client = eventbridge.NewFromConfig(c.configFor(key))
+		c.ebClients[key] = client
+	}
+	return client
+}
+
+// ELBClient returns the Elastic Load Balancing v2 client for the given region and role.
+func (c *Clients) ELBClient(region string, role *config.Role) ELBClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := c.key(region, role)
+	client, ok := c.elbClients[key]
+	if !ok {
+		client = elb.NewFromConfig(c.configFor(key))
+		c.elbClients[key] = client
+	}
+	return client
+}
+
+// CWClient returns the CloudWatch client for the given region and role.
+func (c *Clients) CWClient(region string, role *config.Role) CWClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := c.key(region, role)
+	client, ok := c.cwClients[key]
+	if !ok {
+		client = cloudwatch.NewFromConfig(c.configFor(key))
+		c.cwClients[key] = client
+	}
+	return client
+}
+
+// CDClient returns the CodeDeploy client for the given region and role.
+func (c *Clients) CDClient(region string, role *config.Role) CDClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := c.key(region, role)
+	client, ok := c.cdClients[key]
+	if !ok {
+		client = codedeploy.NewFromConfig(c.configFor(key))
+		c.cdClients[key] = client
+	}
+	return client
+}
+
+// LogsClient returns the CloudWatch Logs client for the given region and role.
+func (c *Clients) LogsClient(region string, role *config.Role) LogsClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := c.key(region, role)
+	client, ok := c.logsClients[key]
+	if !ok {
+		client = cloudwatchlogs.NewFromConfig(c.configFor(key))
+		c.logsClients[key] = client
+	}
+	return client
+}
+
+func (c *Clients) key(region string, role *config.Role) clientKey {
+	key := clientKey{region: region}
+	if key.region == "" {
+		key.region = c.cfg.Region
+	}
+	if role != nil {
+		key.role = *role
+	}
+	return key
+}
+
+// configFor returns the AWS config to use for creating clients for key.
+// c.mu must be held by the caller.
+func (c *Clients) configFor(key clientKey) aws.Config {
+	cfg := c.cfg.Copy()
+	cfg.Region = key.region
+	if key.role.ARN == "" {
+		return cfg
+	}
+
+	// Cache credentials per role so each role is only assumed once
+	// regardless of how many regions it is used in
+	creds, ok := c.credentials[key.role]
+	if !ok {
+		role := key.role
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(c.cfg), role.ARN, func(o *stscreds.AssumeRoleOptions) {
+			if role.ExternalID != "" {
+				o.ExternalID = &role.ExternalID
+			}
+			if role.SessionName != "" {
+				o.RoleSessionName = role.SessionName
+			}
+		})
+		creds = aws.NewCredentialsCache(provider)
+		c.credentials[key.role] = creds
+	}
+	cfg.Credentials = creds
+	return cfg
+}
@@ -0,0 +1,205 @@
+package awsecs
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"log"
+	"strings"
+
+	"github.com/TouchBistro/gehen/config"
+	"github.com/TouchBistro/goutils/color"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	cdtypes "github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/pkg/errors"
+)
+
+// ErrCodeDeployFailed indicates that the CodeDeploy deployment of a service failed or was stopped.
+var ErrCodeDeployFailed = stderrors.New("CodeDeploy deployment failed")
+
+type CDClient interface {
+	CreateDeployment(ctx context.Context, params *codedeploy.CreateDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.CreateDeploymentOutput, error)
+	GetDeployment(ctx context.Context, params *codedeploy.GetDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.GetDeploymentOutput, error)
+	StopDeployment(ctx context.Context, params *codedeploy.StopDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.StopDeploymentOutput, error)
+}
+
+// appSpec is the AppSpec used to deploy a new task definition to an ECS service with CodeDeploy.
+type appSpec struct {
+	Version   json.Number       `json:"version"`
+	Resources []appSpecResource `json:"Resources"`
+}
+
+type appSpecResource struct {
+	TargetService appSpecTargetService `json:"TargetService"`
+}
+
+type appSpecTargetService struct {
+	Type       string            `json:"Type"`
+	Properties appSpecProperties `json:"Properties"`
+}
+
+type appSpecProperties struct {
+	TaskDefinition   string                   `json:"TaskDefinition"`
+	LoadBalancerInfo *appSpecLoadBalancerInfo `json:"LoadBalancerInfo,omitempty"`
+}
+
+type appSpecLoadBalancerInfo struct {
+	ContainerName string `json:"ContainerName"`
+	ContainerPort int32  `json:"ContainerPort"`
+}
+
+// usesCodeDeploy reports whether the ECS service uses the CODE_DEPLOY deployment controller.
+// These services can't be updated with UpdateService, they must be deployed with CodeDeploy.
+func usesCodeDeploy(awsService ecstypes.Service) bool {
+	return awsService.DeploymentController != nil && awsService.DeploymentController.Type == ecstypes.DeploymentControllerTypeCodeDeploy
+}
+
+// codeDeployGroup returns the CodeDeploy application and deployment group of the service.
+// If they are not set the names created by the ECS console for blue/green services are used.
+func codeDeployGroup(service *config.Service) (application, deploymentGroup string) {
+	clusterName := service.Cluster
+	if clusterARN, err := arn.Parse(service.Cluster); err == nil {
+		clusterName = strings.TrimPrefix(clusterARN.Resource, "cluster/")
+	}
+
+	application = service.CodeDeploy.Application
+	if application == "" {
+		application = "AppECS-" + clusterName + "-" + service.Name
+	}
+	deploymentGroup = service.CodeDeploy.DeploymentGroup
+	if deploymentGroup == "" {
+		deploymentGroup = "DgpECS-" + clusterName + "-" + service.Name
+	}
+	return application, deploymentGroup
+}
+
+// updateCodeDeployService deploys service.TaskDefinitionARN with CodeDeploy and sets service.DeploymentID.
+//
+// When rolling back, CodeDeploy only allows one active deployment so if the deployment created by gehen
+// is still active it is stopped and CodeDeploy rolls it back instead. If CodeDeploy already rolled it back
+// after it failed, the rollback deployment is checked instead of creating a new one.
+func updateCodeDeployService(ctx context.Context, service *config.Service, awsService ecstypes.Service, cdClient CDClient) error {
+	if service.DeploymentID != "" {
+		deployment, err := getDeployment(ctx, service.DeploymentID, cdClient)
+		if err != nil {
+			return err
+		}
+
+		switch deployment.Status {
+		case cdtypes.DeploymentStatusSucceeded:
+			// The new version is live, a new deployment is needed to go back
+		case cdtypes.DeploymentStatusFailed, cdtypes.DeploymentStatusStopped:
+			if deployment.RollbackInfo != nil && deployment.RollbackInfo.RollbackDeploymentId != nil {
+				log.Printf("CodeDeploy already rolled back deployment %s of %s\n", service.DeploymentID, color.Cyan(service.Name))
+				service.DeploymentID = *deployment.RollbackInfo.RollbackDeploymentId
+				return nil
+			}
+		default:
+			_, err := cdClient.StopDeployment(ctx, &codedeploy.StopDeploymentInput{
+				DeploymentId:        &service.DeploymentID,
+				AutoRollbackEnabled: aws.Bool(true),
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed to stop CodeDeploy deployment %s of service %s", service.DeploymentID, service.Name)
+			}
+			log.Printf("Stopped CodeDeploy deployment %s of %s, CodeDeploy will roll it back\n", service.DeploymentID, color.Cyan(service.Name))
+			// There is no new deployment to check, CheckDrain waits for the old task set to be the only one left
+			service.DeploymentID = ""
+			return nil
+		}
+	}
+
+	content, err := newAppSpec(service.TaskDefinitionARN, awsService.LoadBalancers)
+	if err != nil {
+		return err
+	}
+	application, deploymentGroup := codeDeployGroup(service)
+	resp, err := cdClient.CreateDeployment(ctx, &codedeploy.CreateDeploymentInput{
+		ApplicationName:     &application,
+		DeploymentGroupName: &deploymentGroup,
+		Description:         aws.String("Deployed by gehen"),
+		Revision: &cdtypes.RevisionLocation{
+			RevisionType:   cdtypes.RevisionLocationTypeAppSpecContent,
+			AppSpecContent: &cdtypes.AppSpecContent{Content: &content},
+		},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to create CodeDeploy deployment for service %s in %s", service.Name, deploymentGroup)
+	}
+
+	service.DeploymentID = aws.ToString(resp.DeploymentId)
+	log.Printf("Created CodeDeploy deployment %s for %s\n", service.DeploymentID, color.Cyan(service.Name))
+	return nil
+}
+
+// newAppSpec returns the AppSpec content for deploying the task definition.
+// Traffic is routed to the container of the first load balancer of the service, if it has one.
+func newAppSpec(taskDefARN string, loadBalancers []ecstypes.LoadBalancer) (string, error) {
+	properties := appSpecProperties{TaskDefinition: taskDefARN}
+	if len(loadBalancers) > 0 {
+		lb := loadBalancers[0]
+		properties.LoadBalancerInfo = &appSpecLoadBalancerInfo{
+			ContainerName: aws.ToString(lb.ContainerName),
+			ContainerPort: aws.ToInt32(lb.ContainerPort),
+		}
+	}
+
+	content, err := json.Marshal(appSpec{
+		Version: "0.0",
+		Resources: []appSpecResource{
+			{TargetService: appSpecTargetService{Type: "AWS::ECS::Service", Properties: properties}},
+		},
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create AppSpec")
+	}
+	return string(content), nil
+}
+
+// checkCodeDeployDrain checks a service deployed by CodeDeploy. It returns true once the
+// deployment succeeded and the only task set left uses taskDefARN. If the deployment failed
+// or was stopped the returned error will wrap ErrCodeDeployFailed.
+func checkCodeDeployDrain(ctx context.Context, service *config.Service, awsService ecstypes.Service, taskDefARN string, cdClient CDClient) (bool, error) {
+	if service.DeploymentID != "" {
+		deployment, err := getDeployment(ctx, service.DeploymentID, cdClient)
+		if err != nil {
+			return false, err
+		}
+
+		switch deployment.Status {
+		case cdtypes.DeploymentStatusSucceeded:
+		case cdtypes.DeploymentStatusFailed, cdtypes.DeploymentStatusStopped:
+			reason := "no reason given"
+			if deployment.ErrorInformation != nil {
+				reason = aws.ToString(deployment.ErrorInformation.Message)
+			}
+			return false, errors.Wrapf(ErrCodeDeployFailed, "deployment %s is %s: %s", service.DeploymentID, deployment.Status, reason)
+		default:
+			log.Printf("CodeDeploy deployment %s of %s is %s\n", service.DeploymentID, color.Cyan(service.Name), deployment.Status)
+			return false, nil
+		}
+	}
+
+	// Once the deployment is finished the task set of the old version is removed
+	if len(awsService.TaskSets) != 1 {
+		log.Printf("%d task sets still running for %s\n", len(awsService.TaskSets), color.Cyan(service.Name))
+		return false, nil
+	}
+	taskSet := awsService.TaskSets[0]
+	return aws.ToString(taskSet.TaskDefinition) == taskDefARN && taskSet.RunningCount == taskSet.ComputedDesiredCount, nil
+}
+
+// getDeployment returns the CodeDeploy deployment with the given ID.
+func getDeployment(ctx context.Context, id string, cdClient CDClient) (*cdtypes.DeploymentInfo, error) {
+	resp, err := cdClient.GetDeployment(ctx, &codedeploy.GetDeploymentInput{DeploymentId: &id})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get CodeDeploy deployment %s", id)
+	}
+	if resp.DeploymentInfo == nil {
+		return nil, errors.Errorf("CodeDeploy deployment %s not found", id)
+	}
+	return resp.DeploymentInfo, nil
+}
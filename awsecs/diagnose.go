@@ -0,0 +1,155 @@
+package awsecs
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TouchBistro/gehen/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxDiagnosisTasks is how many of the most recently stopped tasks are included in a Diagnosis.
+	maxDiagnosisTasks = 5
+	// maxDiagnosisEvents is how many of the latest service events are included in a Diagnosis.
+	maxDiagnosisEvents = 5
+)
+
+// Diagnosis contains details from ECS about why a new version of a service failed.
+type Diagnosis struct {
+	// The most recently stopped tasks using the new task definition, newest first.
+	StoppedTasks []StoppedTask
+	// The IDs of running tasks using the new task definition that are unhealthy.
+	UnhealthyTasks []string
+	// The latest events of the service, newest first.
+	Events []ServiceEvent
+	// The last log lines of the containers of the stopped and unhealthy tasks.
+	Logs []ContainerLogs
+}
+
+// StoppedTask is a task that ECS stopped.
+type StoppedTask struct {
+	ID            string
+	StoppedReason string
+	StoppedAt     time.Time
+	Containers    []StoppedContainer
+}
+
+// StoppedContainer is a container of a stopped task.
+// ExitCode is nil if the container never started.
+type StoppedContainer struct {
+	Name     string
+	ExitCode *int32
+	Reason   string
+}
+
+// ServiceEvent is an event ECS logged for a service, such as tasks being started or failing to be placed.
+type ServiceEvent struct {
+	CreatedAt time.Time
+	Message   string
+}
+
+// Diagnose collects the stopped and unhealthy tasks of service.TaskDefinitionARN and the latest events of the service.
+// The last service.LogLines log lines of the tasks are fetched from CloudWatch Logs for containers using
+// the awslogs log driver, using a client for the region the logs are sent to.
+func Diagnose(ctx context.Context, service *config.Service, ecsClient ECSClient, logsClients LogsClientProvider) (Diagnosis, error) {
+	var diagnosis Diagnosis
+	tasks, err := describeServiceTasks(ctx, service, ecstypes.DesiredStatusStopped, ecsClient)
+	if err != nil {
+		return diagnosis, err
+	}
+	for _, task := range tasks {
+		if aws.ToString(task.TaskDefinitionArn) == service.TaskDefinitionARN {
+			diagnosis.StoppedTasks = append(diagnosis.StoppedTasks, newStoppedTask(task))
+		}
+	}
+	sort.Slice(diagnosis.StoppedTasks, func(i, j int) bool {
+		return diagnosis.StoppedTasks[i].StoppedAt.After(diagnosis.StoppedTasks[j].StoppedAt)
+	})
+	if len(diagnosis.StoppedTasks) > maxDiagnosisTasks {
+		diagnosis.StoppedTasks = diagnosis.StoppedTasks[:maxDiagnosisTasks]
+	}
+
+	tasks, err = describeServiceTasks(ctx, service, ecstypes.DesiredStatusRunning, ecsClient)
+	if err != nil {
+		return diagnosis, err
+	}
+	for _, task := range tasks {
+		if aws.ToString(task.TaskDefinitionArn) == service.TaskDefinitionARN && task.HealthStatus == ecstypes.HealthStatusUnhealthy {
+			diagnosis.UnhealthyTasks = append(diagnosis.UnhealthyTasks, taskID(aws.ToString(task.TaskArn)))
+		}
+		if len(diagnosis.UnhealthyTasks) == maxDiagnosisTasks {
+			break
+		}
+	}
+
+	respDescribeServices, err := ecsClient.DescribeServices(ctx, &ecs.DescribeServicesInput{
+		Services: []string{service.Name},
+		Cluster:  &service.Cluster,
+	})
+	if err != nil {
+		return diagnosis, errors.Wrapf(err, "failed to get service: %s", service.Name)
+	}
+	if len(respDescribeServices.Services) != 1 {
+		return diagnosis, errors.Errorf("expected 1 service named %s, got %d", service.Name, len(respDescribeServices.Services))
+	}
+	// ECS returns events newest first
+	for i, e := range respDescribeServices.Services[0].Events {
+		if i == maxDiagnosisEvents {
+			break
+		}
+		diagnosis.Events = append(diagnosis.Events, ServiceEvent{
+			CreatedAt: aws.ToTime(e.CreatedAt),
+			Message:   aws.ToString(e.Message),
+		})
+	}
+
+	taskIDs := diagnosis.UnhealthyTasks
+	for _, task := range diagnosis.StoppedTasks {
+		taskIDs = append(taskIDs, task.ID)
+	}
+	if len(taskIDs) == 0 {
+		return diagnosis, nil
+	}
+	configs, err := awslogsConfigs(ctx, service.TaskDefinitionARN, ecsClient)
+	if err != nil {
+		return diagnosis, err
+	}
+	lines := service.LogLines
+	if lines == 0 {
+		lines = defaultLogLines
+	}
+	diagnosis.Logs = tailLogs(ctx, service, taskIDs, configs, lines, logsClients)
+	return diagnosis, nil
+}
+
+func newStoppedTask(task ecstypes.Task) StoppedTask {
+	stoppedTask := StoppedTask{
+		ID:            taskID(aws.ToString(task.TaskArn)),
+		StoppedReason: aws.ToString(task.StoppedReason),
+		StoppedAt:     aws.ToTime(task.StoppedAt),
+	}
+	for _, c := range task.Containers {
+		stoppedTask.Containers = append(stoppedTask.Containers, StoppedContainer{
+			Name:     aws.ToString(c.Name),
+			ExitCode: c.ExitCode,
+			Reason:   aws.ToString(c.Reason),
+		})
+	}
+	return stoppedTask
+}
+
+// taskID returns the ID of the task, which is what the ECS console shows and awslogs uses in stream names.
+func taskID(taskARN string) string {
+	// Task ARNs end with the task ID
+	if parsed, err := arn.Parse(taskARN); err == nil {
+		return parsed.Resource[strings.LastIndex(parsed.Resource, "/")+1:]
+	}
+	return taskARN
+}
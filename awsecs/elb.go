@@ -0,0 +1,189 @@
+package awsecs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/TouchBistro/gehen/config"
+	"github.com/TouchBistro/goutils/color"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbtypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/pkg/errors"
+)
+
+type ELBClient interface {
+	DescribeTargetHealth(ctx context.Context, params *elb.DescribeTargetHealthInput, optFns ...func(*elb.Options)) (*elb.DescribeTargetHealthOutput, error)
+}
+
+// CheckTargetHealth checks the target groups the service is registered with. It returns true
+// once the targets of every running task using taskDefARN are healthy and all other targets,
+// which belong to old tasks, have been deregistered.
+//
+// Tasks using the awsvpc network mode are registered by IP address and container port.
+// Tasks using the bridge or host network modes are registered by the EC2 instance they
+// run on and the host port the container port is mapped to.
+func CheckTargetHealth(ctx context.Context, service *config.Service, taskDefARN string, loadBalancers []ecstypes.LoadBalancer, ecsClient ECSClient, elbClient ELBClient) (bool, error) {
+	tasks, err := describeServiceTasks(ctx, service, ecstypes.DesiredStatusRunning, ecsClient)
+	if err != nil {
+		return false, err
+	}
+
+	var newTasks []ecstypes.Task
+	for _, task := range tasks {
+		if aws.ToString(task.TaskDefinitionArn) == taskDefARN {
+			newTasks = append(newTasks, task)
+		}
+	}
+	instanceIDs, err := describeInstanceIDs(ctx, service, newTasks, ecsClient)
+	if err != nil {
+		return false, err
+	}
+
+	for _, lb := range loadBalancers {
+		// Classic load balancers have no target groups
+		if lb.TargetGroupArn == nil {
+			continue
+		}
+
+		respTargetHealth, err := elbClient.DescribeTargetHealth(ctx, &elb.DescribeTargetHealthInput{
+			TargetGroupArn: lb.TargetGroupArn,
+		})
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to get target health of %s", *lb.TargetGroupArn)
+		}
+
+		// Targets of the new tasks, a task's target is unknown until its port is mapped
+		newTargets := make(map[string]bool)
+		for _, task := range newTasks {
+			if target := taskTarget(task, lb, instanceIDs); target != "" {
+				newTargets[target] = true
+			}
+		}
+
+		healthy := 0
+		old := 0
+		for _, d := range respTargetHealth.TargetHealthDescriptions {
+			if d.Target == nil || d.TargetHealth == nil {
+				continue
+			}
+			id := aws.ToString(d.Target.Id)
+			port := aws.ToInt32(d.Target.Port)
+			// The same task can be registered with several ports of a target group when using awsvpc.
+			// Instance targets use host ports which are usually mapped dynamically so can't be compared.
+			if net.ParseIP(id) != nil && lb.ContainerPort != nil && d.Target.Port != nil && port != *lb.ContainerPort {
+				continue
+			}
+
+			state := d.TargetHealth.State
+			if newTargets[targetKey(id, port)] {
+				if state == elbtypes.TargetHealthStateEnumHealthy {
+					healthy++
+				}
+				continue
+			}
+			if state != elbtypes.TargetHealthStateEnumUnused {
+				old++
+			}
+		}
+
+		if healthy < len(newTasks) || old > 0 {
+			log.Printf(
+				"%d of %d new targets healthy and %d old targets still registered in %s for %s\n",
+				healthy,
+				len(newTasks),
+				old,
+				color.Blue(*lb.TargetGroupArn),
+				color.Cyan(service.Name),
+			)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// taskTarget returns the key of the target the task is registered as in the load balancer's target group.
+// It is empty if the target isn't known yet.
+func taskTarget(task ecstypes.Task, lb ecstypes.LoadBalancer, instanceIDs map[string]string) string {
+	if ip := taskPrivateIP(task); ip != "" {
+		return targetKey(ip, aws.ToInt32(lb.ContainerPort))
+	}
+
+	instanceID := instanceIDs[aws.ToString(task.ContainerInstanceArn)]
+	if instanceID == "" {
+		return ""
+	}
+	for _, c := range task.Containers {
+		if aws.ToString(c.Name) != aws.ToString(lb.ContainerName) {
+			continue
+		}
+		for _, b := range c.NetworkBindings {
+			if aws.ToInt32(b.ContainerPort) == aws.ToInt32(lb.ContainerPort) {
+				return targetKey(instanceID, aws.ToInt32(b.HostPort))
+			}
+		}
+	}
+	return ""
+}
+
+func targetKey(id string, port int32) string {
+	return fmt.Sprintf("%s:%d", id, port)
+}
+
+// taskPrivateIP returns the private IP address of the task's network interface.
+// It is empty if the task doesn't use the awsvpc network mode.
+func taskPrivateIP(task ecstypes.Task) string {
+	for _, attachment := range task.Attachments {
+		if aws.ToString(attachment.Type) != "ElasticNetworkInterface" {
+			continue
+		}
+		for _, detail := range attachment.Details {
+			if aws.ToString(detail.Name) == "privateIPv4Address" {
+				return aws.ToString(detail.Value)
+			}
+		}
+	}
+	return ""
+}
+
+// describeInstanceIDs returns the EC2 instance ID of each container instance the tasks
+// that don't use the awsvpc network mode run on, by container instance ARN.
+func describeInstanceIDs(ctx context.Context, service *config.Service, tasks []ecstypes.Task, ecsClient ECSClient) (map[string]string, error) {
+	seen := make(map[string]bool)
+	var arns []string
+	for _, task := range tasks {
+		arn := aws.ToString(task.ContainerInstanceArn)
+		if arn == "" || taskPrivateIP(task) != "" || seen[arn] {
+			continue
+		}
+		seen[arn] = true
+		arns = append(arns, arn)
+	}
+
+	instanceIDs := make(map[string]string)
+	if len(arns) == 0 {
+		return instanceIDs, nil
+	}
+	// DescribeContainerInstances accepts as many ARNs as DescribeTasks
+	for start := 0; start < len(arns); start += maxDescribeTasks {
+		end := start + maxDescribeTasks
+		if end > len(arns) {
+			end = len(arns)
+		}
+		resp, err := ecsClient.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{
+			Cluster:            &service.Cluster,
+			ContainerInstances: arns[start:end],
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get container instances for service: %s", service.Name)
+		}
+		for _, ci := range resp.ContainerInstances {
+			instanceIDs[aws.ToString(ci.ContainerInstanceArn)] = aws.ToString(ci.Ec2InstanceId)
+		}
+	}
+	return instanceIDs, nil
+}
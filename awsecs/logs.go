@@ -0,0 +1,124 @@
+package awsecs
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/TouchBistro/gehen/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/pkg/errors"
+)
+
+// defaultLogLines is how many of the last log lines of each container are included in a Diagnosis
+// if the service doesn't set its own number.
+const defaultLogLines = 20
+
+type LogsClient interface {
+	GetLogEvents(ctx context.Context, params *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error)
+}
+
+// ContainerLogs are the last lines a container of a failed task logged to CloudWatch Logs.
+type ContainerLogs struct {
+	TaskID    string
+	Container string
+	Region    string
+	LogGroup  string
+	LogStream string
+	Lines     []string
+	// Set if the logs could not be fetched, the rest of the diagnosis is still useful without them
+	Err error
+}
+
+// awslogsConfig is where a container using the awslogs log driver sends its logs.
+type awslogsConfig struct {
+	// Empty if the logs are in the region of the service
+	region       string
+	group        string
+	streamPrefix string
+}
+
+// awslogsConfigs returns the awslogs config of each container of the task definition by container name.
+// Containers without a stream prefix are skipped since the name of their log streams can't be known.
+func awslogsConfigs(ctx context.Context, taskDefARN string, ecsClient ECSClient) (map[string]awslogsConfig, error) {
+	resp, err := ecsClient.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: &taskDefARN,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get task definition: %s", taskDefARN)
+	}
+
+	configs := make(map[string]awslogsConfig)
+	for _, c := range resp.TaskDefinition.ContainerDefinitions {
+		lc := c.LogConfiguration
+		if lc == nil || lc.LogDriver != ecstypes.LogDriverAwslogs {
+			continue
+		}
+		cfg := awslogsConfig{
+			region:       lc.Options["awslogs-region"],
+			group:        lc.Options["awslogs-group"],
+			streamPrefix: lc.Options["awslogs-stream-prefix"],
+		}
+		if cfg.group == "" || cfg.streamPrefix == "" {
+			continue
+		}
+		configs[aws.ToString(c.Name)] = cfg
+	}
+	return configs, nil
+}
+
+// tailLogs returns the last lines log lines of each container of the given tasks that logs to CloudWatch Logs.
+// The logs are read from the region set in the awslogs config of each container.
+func tailLogs(ctx context.Context, service *config.Service, taskIDs []string, configs map[string]awslogsConfig, lines int, logsClients LogsClientProvider) []ContainerLogs {
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var logs []ContainerLogs
+	for _, taskID := range taskIDs {
+		for _, name := range names {
+			cfg := configs[name]
+			region := cfg.region
+			if region == "" {
+				region = service.Region
+			}
+			containerLogs := ContainerLogs{
+				TaskID:    taskID,
+				Container: name,
+				Region:    region,
+				LogGroup:  cfg.group,
+				// The awslogs driver names streams prefix/container-name/task-id
+				LogStream: strings.Join([]string{cfg.streamPrefix, name, taskID}, "/"),
+			}
+			logsClient := logsClients.LogsClient(region, service.Role)
+			containerLogs.Lines, containerLogs.Err = getLastLogLines(ctx, containerLogs.LogGroup, containerLogs.LogStream, lines, logsClient)
+			logs = append(logs, containerLogs)
+		}
+	}
+	return logs
+}
+
+// getLastLogLines returns the last lines log lines of the log stream, oldest first.
+func getLastLogLines(ctx context.Context, group, stream string, lines int, logsClient LogsClient) ([]string, error) {
+	resp, err := logsClient.GetLogEvents(ctx, &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  &group,
+		LogStreamName: &stream,
+		Limit:         aws.Int32(int32(lines)),
+		// Start from the end of the stream to get the latest lines
+		StartFromHead: aws.Bool(false),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get logs from %s/%s", group, stream)
+	}
+
+	var logLines []string
+	for _, e := range resp.Events {
+		logLines = append(logLines, strings.TrimRight(aws.ToString(e.Message), "\n"))
+	}
+	return logLines, nil
+}
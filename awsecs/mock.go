@@ -2,14 +2,27 @@ package awsecs
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/TouchBistro/gehen/config"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	logstypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	cdtypes "github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbtypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
 	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
 	ebtypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
 )
@@ -18,12 +31,31 @@ type mockService struct {
 	name             string
 	taskDefVersion   int
 	imageName        string
-	gitsha           string
 	deploymentStatus string
+	// Git SHAs of each task def revision, index 0 is revision 1
+	revisionGitshas []string
+	loadBalancers   []ecstypes.LoadBalancer
+	controller      ecstypes.DeploymentControllerType
+	// Set if the deployment circuit breaker failed the current deployment
+	failedReason string
+	rolledBack   bool
+	updates      int
+	// Newest first like ECS returns them
+	events []ecstypes.ServiceEvent
+	// Returned by the next describeErrors calls to DescribeServices for the service
+	describeErr    error
+	describeErrors int
+	// The cluster and task def of the primary task set if the service uses CodeDeploy
+	taskSetCluster string
+	taskSetTaskDef string
 }
 
 func (ms *mockService) TaskDefinitionArn() string {
-	return fmt.Sprintf("arn:aws:ecs:us-east-1:123456:task-definition/%s:%d", ms.name, ms.taskDefVersion)
+	return ms.revisionArn(ms.taskDefVersion)
+}
+
+func (ms *mockService) revisionArn(revision int) string {
+	return fmt.Sprintf("arn:aws:ecs:us-east-1:123456:task-definition/%s:%d", ms.name, revision)
 }
 
 type mockTask struct {
@@ -32,6 +64,15 @@ type mockTask struct {
 	healthy     bool
 	serviceName string
 	clusterName string
+	lastStatus  string
+	// Set if the task uses the awsvpc network mode
+	ip string
+	// Set if the task uses the bridge network mode
+	instanceID string
+	hostPort   int32
+	// Set once the task is stopped
+	stoppedReason string
+	exitCode      *int32
 }
 
 func (mt *mockTask) Arn() string {
@@ -47,7 +88,9 @@ func (mt *mockTask) HealthStatus() ecstypes.HealthStatus {
 
 type MockECSClient struct {
 	services map[string]*mockService
-	tasks    []mockTask
+	// Guards tasks since services are deployed concurrently
+	mu    sync.Mutex
+	tasks []mockTask
 }
 
 func NewMockECSClient(serviceNames []string, imageName, gitsha string) *MockECSClient {
@@ -58,8 +101,8 @@ func NewMockECSClient(serviceNames []string, imageName, gitsha string) *MockECSC
 			name:             s,
 			taskDefVersion:   1,
 			imageName:        imageName,
-			gitsha:           gitsha,
 			deploymentStatus: "PRIMARY",
+			revisionGitshas:  []string{gitsha},
 		}
 	}
 
@@ -68,6 +111,11 @@ func NewMockECSClient(serviceNames []string, imageName, gitsha string) *MockECSC
 	}
 }
 
+// ECSClient implements ECSClientProvider by returning the same mock for every region and role.
+func (mc *MockECSClient) ECSClient(region string, role *config.Role) ECSClient {
+	return mc
+}
+
 func (mc *MockECSClient) SetServiceStatus(name, status string) {
 	s, ok := mc.services[name]
 	if !ok {
@@ -77,57 +125,205 @@ func (mc *MockECSClient) SetServiceStatus(name, status string) {
 	s.deploymentStatus = status
 }
 
+// FailDeployment makes the deployment circuit breaker fail the current deployment of the service.
+// If rollback is true the circuit breaker also rolls the service back to the previous revision.
+func (mc *MockECSClient) FailDeployment(name, reason string, rollback bool) {
+	s, ok := mc.services[name]
+	if !ok {
+		panic(fmt.Sprintf("mock ECS service %s not found", name))
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	s.failedReason = reason
+	s.rolledBack = rollback
+	if rollback {
+		for i := range mc.tasks {
+			if mc.tasks[i].serviceName == name {
+				mc.tasks[i].taskDefArn = s.revisionArn(s.taskDefVersion - 1)
+			}
+		}
+	}
+}
+
+// UpdateCount returns how many times UpdateService was called for the service.
+func (mc *MockECSClient) UpdateCount(name string) int {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.services[name].updates
+}
+
+// UseCodeDeploy switches the service to the CODE_DEPLOY deployment controller so it can only
+// be deployed using MockCodeDeployClient. Its tasks are created in the given cluster.
+func (mc *MockECSClient) UseCodeDeploy(name, clusterName string) {
+	s, ok := mc.services[name]
+	if !ok {
+		panic(fmt.Sprintf("mock ECS service %s not found", name))
+	}
+
+	s.controller = ecstypes.DeploymentControllerTypeCodeDeploy
+	s.taskSetCluster = clusterName
+	s.taskSetTaskDef = s.TaskDefinitionArn()
+}
+
+// AddMockLoadBalancer registers the service with the target group, sending traffic to containerPort.
+func (mc *MockECSClient) AddMockLoadBalancer(name, targetGroupArn string, containerPort int32) {
+	s, ok := mc.services[name]
+	if !ok {
+		panic(fmt.Sprintf("mock ECS service %s not found", name))
+	}
+
+	s.loadBalancers = append(s.loadBalancers, ecstypes.LoadBalancer{
+		TargetGroupArn: aws.String(targetGroupArn),
+		ContainerName:  aws.String(s.imageName),
+		ContainerPort:  aws.Int32(containerPort),
+	})
+}
+
 func (mc *MockECSClient) DescribeServices(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
 	var outServices []ecstypes.Service
 	for _, serviceName := range params.Services {
 		s, ok := mc.services[serviceName]
 		if !ok {
 			return nil, errors.New("service not found")
 		}
+		if s.describeErrors > 0 {
+			s.describeErrors--
+			return nil, s.describeErr
+		}
+		if s.controller == ecstypes.DeploymentControllerTypeCodeDeploy {
+			// CodeDeploy services have task sets instead of deployments
+			outServices = append(outServices, ecstypes.Service{
+				ServiceName:          aws.String(s.name),
+				TaskDefinition:       aws.String(s.taskSetTaskDef),
+				DeploymentController: &ecstypes.DeploymentController{Type: s.controller},
+				TaskSets: []ecstypes.TaskSet{
+					{
+						TaskDefinition:       aws.String(s.taskSetTaskDef),
+						Status:               aws.String("PRIMARY"),
+						RunningCount:         2,
+						ComputedDesiredCount: 2,
+					},
+				},
+				LoadBalancers: s.loadBalancers,
+			})
+			continue
+		}
+		deployment := ecstypes.Deployment{
+			Id:             aws.String(fmt.Sprintf("ecs-svc/%s-%d", s.name, s.taskDefVersion)),
+			TaskDefinition: aws.String(s.TaskDefinitionArn()),
+			Status:         aws.String(s.deploymentStatus),
+			// TODO should this be configurable?
+			RunningCount: 2,
+			DesiredCount: 2,
+		}
+		if s.failedReason != "" {
+			deployment.RolloutState = ecstypes.DeploymentRolloutStateFailed
+			deployment.RolloutStateReason = aws.String(s.failedReason)
+		}
+		taskDefArn := s.TaskDefinitionArn()
+		deployments := []ecstypes.Deployment{deployment}
+		if s.rolledBack {
+			// The circuit breaker started a new deployment of the previous revision
+			taskDefArn = s.revisionArn(s.taskDefVersion - 1)
+			deployments[0].Status = aws.String("ACTIVE")
+			deployments = append([]ecstypes.Deployment{{
+				Id:             aws.String(fmt.Sprintf("ecs-svc/%s-%d-rollback", s.name, s.taskDefVersion)),
+				TaskDefinition: aws.String(taskDefArn),
+				Status:         aws.String("PRIMARY"),
+				RolloutState:   ecstypes.DeploymentRolloutStateCompleted,
+				RunningCount:   2,
+				DesiredCount:   2,
+			}}, deployments...)
+		}
 		outServices = append(outServices, ecstypes.Service{
 			ServiceName:    aws.String(s.name),
-			TaskDefinition: aws.String(s.TaskDefinitionArn()),
-			Deployments: []ecstypes.Deployment{
-				{
-					TaskDefinition: aws.String(s.TaskDefinitionArn()),
-					Status:         aws.String(s.deploymentStatus),
-					// TODO should this be configurable?
-					RunningCount: 2,
-					DesiredCount: 2,
-				},
-			},
+			TaskDefinition: aws.String(taskDefArn),
+			Deployments:    deployments,
+			LoadBalancers:  s.loadBalancers,
+			Events:         s.events,
 		})
 	}
 	return &ecs.DescribeServicesOutput{Services: outServices}, nil
 }
 
-func (mc *MockECSClient) DescribeTaskDefinition(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
-	var service *mockService
+// AddMockRevision registers a new task def revision for the service using the given Git SHA
+// without changing the revision the service is using.
+func (mc *MockECSClient) AddMockRevision(name, gitsha string) {
+	s, ok := mc.services[name]
+	if !ok {
+		panic(fmt.Sprintf("mock ECS service %s not found", name))
+	}
+
+	s.revisionGitshas = append(s.revisionGitshas, gitsha)
+}
+
+// findRevision returns the service and revision of the given task def ARN.
+// service is nil if no revision has the ARN.
+func (mc *MockECSClient) findRevision(taskDefArn string) (service *mockService, revision int) {
 	for _, s := range mc.services {
-		if s.TaskDefinitionArn() == *params.TaskDefinition {
-			service = s
+		for i := range s.revisionGitshas {
+			if s.revisionArn(i+1) == taskDefArn {
+				return s, i + 1
+			}
 		}
 	}
+	return nil, 0
+}
 
+func (ms *mockService) revisionImage(revision int) string {
+	return fmt.Sprintf("123456.dkr.ecr.us-east-1.amazonaws.com/%s:%s", ms.imageName, ms.revisionGitshas[revision-1])
+}
+
+func (mc *MockECSClient) DescribeTaskDefinition(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+	service, revision := mc.findRevision(*params.TaskDefinition)
 	if service == nil {
 		return nil, errors.New("task Definition not found")
 	}
 
-	image := fmt.Sprintf("123456.dkr.ecr.us-east-1.amazonaws.com/%s:%s", service.imageName, service.gitsha)
 	return &ecs.DescribeTaskDefinitionOutput{
 		TaskDefinition: &ecstypes.TaskDefinition{
 			ContainerDefinitions: []ecstypes.ContainerDefinition{
 				{
-					Image: aws.String(image),
+					Name:  aws.String(service.imageName),
+					Image: aws.String(service.revisionImage(revision)),
+					HealthCheck: &ecstypes.HealthCheck{
+						Command: []string{"CMD-SHELL", "curl -f http://localhost/ping"},
+					},
+					LogConfiguration: &ecstypes.LogConfiguration{
+						LogDriver: ecstypes.LogDriverAwslogs,
+						Options: map[string]string{
+							"awslogs-group":         "/ecs/" + service.name,
+							"awslogs-region":        "us-east-1",
+							"awslogs-stream-prefix": "ecs",
+						},
+					},
 				},
 			},
 			// This is the actual task def name
 			Family:            aws.String(service.name),
-			TaskDefinitionArn: aws.String(service.TaskDefinitionArn()),
+			TaskDefinitionArn: aws.String(service.revisionArn(revision)),
+			Revision:          int32(revision),
 		},
 	}, nil
 }
 
+func (mc *MockECSClient) ListTaskDefinitions(ctx context.Context, params *ecs.ListTaskDefinitionsInput, optFns ...func(*ecs.Options)) (*ecs.ListTaskDefinitionsOutput, error) {
+	var arns []string
+	for _, s := range mc.services {
+		if params.FamilyPrefix != nil && !strings.HasPrefix(s.name, *params.FamilyPrefix) {
+			continue
+		}
+		// Newest first
+		for i := len(s.revisionGitshas); i > 0; i-- {
+			arns = append(arns, s.revisionArn(i))
+		}
+	}
+	return &ecs.ListTaskDefinitionsOutput{TaskDefinitionArns: arns}, nil
+}
+
 func (mc *MockECSClient) RegisterTaskDefinition(ctx context.Context, params *ecs.RegisterTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.RegisterTaskDefinitionOutput, error) {
 	service, ok := mc.services[*params.Family]
 	if !ok {
@@ -135,7 +331,9 @@ func (mc *MockECSClient) RegisterTaskDefinition(ctx context.Context, params *ecs
 	}
 
 	// "Create" new task def version
-	service.taskDefVersion++
+	t := strings.Split(*params.ContainerDefinitions[0].Image, ":")
+	service.revisionGitshas = append(service.revisionGitshas, t[len(t)-1])
+	service.taskDefVersion = len(service.revisionGitshas)
 	return &ecs.RegisterTaskDefinitionOutput{
 		TaskDefinition: &ecstypes.TaskDefinition{
 			TaskDefinitionArn: aws.String(service.TaskDefinitionArn()),
@@ -143,17 +341,53 @@ func (mc *MockECSClient) RegisterTaskDefinition(ctx context.Context, params *ecs
 	}, nil
 }
 
+// UpdateService completes the deployment immediately. All tasks of the service are switched
+// to the new task def, if the service has no tasks two healthy ones are started.
 func (mc *MockECSClient) UpdateService(ctx context.Context, params *ecs.UpdateServiceInput, optFns ...func(*ecs.Options)) (*ecs.UpdateServiceOutput, error) {
-	_, ok := mc.services[*params.Service]
+	s, ok := mc.services[*params.Service]
 	if !ok {
 		return nil, errors.New("service not found")
 	}
+	if s.controller == ecstypes.DeploymentControllerTypeCodeDeploy {
+		return nil, errors.New("cannot update the task definition of a service using the CODE_DEPLOY deployment controller")
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	s.updates++
+	s.failedReason = ""
+	s.rolledBack = false
+	if _, revision := mc.findRevision(*params.TaskDefinition); revision != 0 {
+		s.taskDefVersion = revision
+	}
+	mc.replaceTasks(*params.Cluster, *params.Service, *params.TaskDefinition)
 
 	// We don't actually use the return value
 	return &ecs.UpdateServiceOutput{}, nil
 }
 
+// replaceTasks switches all tasks of the service to the task def, if the service
+// has no tasks two healthy ones are started. mc.mu must be held by the caller.
+func (mc *MockECSClient) replaceTasks(clusterName, serviceName, taskDefArn string) {
+	found := false
+	for i := range mc.tasks {
+		if mc.tasks[i].serviceName == serviceName {
+			mc.tasks[i].taskDefArn = taskDefArn
+			found = true
+		}
+	}
+	if !found {
+		mc.createMockTasks(clusterName, serviceName, taskDefArn, true, 2)
+	}
+}
+
 func (mc *MockECSClient) CreateMockTasks(clusterName, serviceName, taskDefArn string, healthy bool, count int) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.createMockTasks(clusterName, serviceName, taskDefArn, healthy, count)
+}
+
+func (mc *MockECSClient) createMockTasks(clusterName, serviceName, taskDefArn string, healthy bool, count int) {
 	for i := 0; i < count; i++ {
 		mc.tasks = append(mc.tasks, mockTask{
 			id:          strconv.Itoa(rand.Int()),
@@ -161,11 +395,122 @@ func (mc *MockECSClient) CreateMockTasks(clusterName, serviceName, taskDefArn st
 			serviceName: serviceName,
 			taskDefArn:  taskDefArn,
 			healthy:     healthy,
+			lastStatus:  string(ecstypes.DesiredStatusRunning),
+			ip:          fmt.Sprintf("10.0.%d.%d", len(mc.tasks)/250, len(mc.tasks)%250+1),
 		})
 	}
 }
 
+// CreateMockBridgeTasks creates running tasks using the bridge network mode on the EC2 instance.
+// The container port of each task is mapped to a different host port.
+func (mc *MockECSClient) CreateMockBridgeTasks(clusterName, serviceName, taskDefArn, instanceID string, healthy bool, count int) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for i := 0; i < count; i++ {
+		mc.tasks = append(mc.tasks, mockTask{
+			id:          strconv.Itoa(rand.Int()),
+			clusterName: clusterName,
+			serviceName: serviceName,
+			taskDefArn:  taskDefArn,
+			healthy:     healthy,
+			lastStatus:  string(ecstypes.DesiredStatusRunning),
+			instanceID:  instanceID,
+			hostPort:    int32(32768 + len(mc.tasks)),
+		})
+	}
+}
+
+// TaskHostPorts returns the host ports of the service's bridge network mode tasks using the task def.
+func (mc *MockECSClient) TaskHostPorts(serviceName, taskDefArn string) []int32 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	var ports []int32
+	for _, t := range mc.tasks {
+		if t.serviceName == serviceName && t.taskDefArn == taskDefArn && t.hostPort != 0 {
+			ports = append(ports, t.hostPort)
+		}
+	}
+	return ports
+}
+
+// StopMockTasks stops the running tasks of the service using the task def. The containers
+// of the tasks exit with exitCode and the tasks are stopped with the given reason.
+func (mc *MockECSClient) StopMockTasks(serviceName, taskDefArn, reason string, exitCode int32) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	for i := range mc.tasks {
+		t := &mc.tasks[i]
+		if t.serviceName == serviceName && t.taskDefArn == taskDefArn && t.lastStatus == string(ecstypes.DesiredStatusRunning) {
+			t.lastStatus = string(ecstypes.DesiredStatusStopped)
+			t.stoppedReason = reason
+			t.exitCode = aws.Int32(exitCode)
+		}
+	}
+}
+
+// MockTaskIDs returns the IDs of the tasks of the service using the task def with the given status.
+func (mc *MockECSClient) MockTaskIDs(serviceName, taskDefArn string, status ecstypes.DesiredStatus) []string {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	var ids []string
+	for _, t := range mc.tasks {
+		if t.serviceName == serviceName && t.taskDefArn == taskDefArn && t.lastStatus == string(status) {
+			ids = append(ids, t.id)
+		}
+	}
+	return ids
+}
+
+// FailDescribeServices makes the next count calls to DescribeServices for the service return err.
+func (mc *MockECSClient) FailDescribeServices(name string, err error, count int) {
+	s, ok := mc.services[name]
+	if !ok {
+		panic(fmt.Sprintf("mock ECS service %s not found", name))
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	s.describeErr = err
+	s.describeErrors = count
+}
+
+// AddServiceEvent adds an event with the message to the service as of now.
+func (mc *MockECSClient) AddServiceEvent(name, message string) {
+	s, ok := mc.services[name]
+	if !ok {
+		panic(fmt.Sprintf("mock ECS service %s not found", name))
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	event := ecstypes.ServiceEvent{
+		Id:        aws.String(strconv.Itoa(len(s.events) + 1)),
+		CreatedAt: aws.Time(time.Now()),
+		Message:   aws.String(fmt.Sprintf("(service %s) %s", name, message)),
+	}
+	s.events = append([]ecstypes.ServiceEvent{event}, s.events...)
+}
+
+// TaskIPs returns the private IP addresses of the service's tasks using the task def.
+func (mc *MockECSClient) TaskIPs(serviceName, taskDefArn string) []string {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	var ips []string
+	for _, t := range mc.tasks {
+		if t.serviceName == serviceName && t.taskDefArn == taskDefArn {
+			ips = append(ips, t.ip)
+		}
+	}
+	return ips
+}
+
 func (mc *MockECSClient) ListTasks(ctx context.Context, params *ecs.ListTasksInput, optFns ...func(*ecs.Options)) (*ecs.ListTasksOutput, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
 	var taskArns []string
 	for _, t := range mc.tasks {
 		if params.Cluster != nil && t.clusterName != *params.Cluster {
@@ -174,12 +519,39 @@ func (mc *MockECSClient) ListTasks(ctx context.Context, params *ecs.ListTasksInp
 		if params.ServiceName != nil && t.serviceName != *params.ServiceName {
 			continue
 		}
+		if params.DesiredStatus != "" && t.lastStatus != string(params.DesiredStatus) {
+			continue
+		}
 		taskArns = append(taskArns, t.Arn())
 	}
-	return &ecs.ListTasksOutput{TaskArns: taskArns}, nil
+
+	// Page the results like ECS, which returns 100 tasks per page by default
+	pageSize := 100
+	if params.MaxResults != nil {
+		pageSize = int(*params.MaxResults)
+	}
+	start := 0
+	if params.NextToken != nil {
+		var err error
+		if start, err = strconv.Atoi(*params.NextToken); err != nil || start > len(taskArns) {
+			return nil, fmt.Errorf("invalid next token: %s", *params.NextToken)
+		}
+	}
+	output := &ecs.ListTasksOutput{TaskArns: taskArns[start:]}
+	if len(output.TaskArns) > pageSize {
+		output.TaskArns = output.TaskArns[:pageSize]
+		output.NextToken = aws.String(strconv.Itoa(start + pageSize))
+	}
+	return output, nil
 }
 
 func (mc *MockECSClient) DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+	if len(params.Tasks) > 100 {
+		return nil, fmt.Errorf("at most 100 tasks can be described at once, got %d", len(params.Tasks))
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
 	arnSet := make(map[string]bool)
 	for _, arn := range params.Tasks {
 		arnSet[arn] = true
@@ -194,15 +566,391 @@ func (mc *MockECSClient) DescribeTasks(ctx context.Context, params *ecs.Describe
 		if params.Tasks != nil && !ok {
 			continue
 		}
-		tasks = append(tasks, ecstypes.Task{
+		task := ecstypes.Task{
 			TaskArn:           aws.String(t.Arn()),
 			TaskDefinitionArn: aws.String(t.taskDefArn),
 			HealthStatus:      t.HealthStatus(),
-		})
+			LastStatus:        aws.String(t.lastStatus),
+		}
+		if t.ip != "" {
+			task.Attachments = []ecstypes.Attachment{
+				{
+					Type: aws.String("ElasticNetworkInterface"),
+					Details: []ecstypes.KeyValuePair{
+						{Name: aws.String("privateIPv4Address"), Value: aws.String(t.ip)},
+					},
+				},
+			}
+		}
+		if t.instanceID != "" {
+			task.ContainerInstanceArn = aws.String(mockContainerInstanceArn(t.clusterName, t.instanceID))
+		}
+		if service, revision := mc.findRevision(t.taskDefArn); service != nil {
+			task.Containers = []ecstypes.Container{
+				{
+					Name:         aws.String(service.imageName),
+					Image:        aws.String(service.revisionImage(revision)),
+					HealthStatus: t.HealthStatus(),
+					ExitCode:     t.exitCode,
+				},
+			}
+			if t.hostPort != 0 {
+				for _, lb := range service.loadBalancers {
+					task.Containers[0].NetworkBindings = append(task.Containers[0].NetworkBindings, ecstypes.NetworkBinding{
+						ContainerPort: lb.ContainerPort,
+						HostPort:      aws.Int32(t.hostPort),
+					})
+				}
+			}
+		}
+		if t.stoppedReason != "" {
+			task.StoppedReason = aws.String(t.stoppedReason)
+			task.StoppedAt = aws.Time(time.Now())
+		}
+		tasks = append(tasks, task)
 	}
 	return &ecs.DescribeTasksOutput{Tasks: tasks}, nil
 }
 
+func mockContainerInstanceArn(clusterName, instanceID string) string {
+	return fmt.Sprintf("arn:aws:ecs:us-east-1:123456:container-instance/%s/%s", clusterName, instanceID)
+}
+
+func (mc *MockECSClient) DescribeContainerInstances(ctx context.Context, params *ecs.DescribeContainerInstancesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeContainerInstancesOutput, error) {
+	if len(params.ContainerInstances) > 100 {
+		return nil, fmt.Errorf("at most 100 container instances can be described at once, got %d", len(params.ContainerInstances))
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	arnSet := make(map[string]bool)
+	for _, arn := range params.ContainerInstances {
+		arnSet[arn] = true
+	}
+
+	var instances []ecstypes.ContainerInstance
+	seen := make(map[string]bool)
+	for _, t := range mc.tasks {
+		arn := mockContainerInstanceArn(t.clusterName, t.instanceID)
+		if t.instanceID == "" || !arnSet[arn] || seen[arn] {
+			continue
+		}
+		seen[arn] = true
+		instances = append(instances, ecstypes.ContainerInstance{
+			ContainerInstanceArn: aws.String(arn),
+			Ec2InstanceId:        aws.String(t.instanceID),
+		})
+	}
+	return &ecs.DescribeContainerInstancesOutput{ContainerInstances: instances}, nil
+}
+
+// Elastic Load Balancing mocks
+
+type MockELBClient struct {
+	mu           sync.Mutex
+	targetGroups map[string][]elbtypes.TargetHealthDescription
+}
+
+func NewMockELBClient() *MockELBClient {
+	return &MockELBClient{
+		targetGroups: make(map[string][]elbtypes.TargetHealthDescription),
+	}
+}
+
+// ELBClient implements ELBClientProvider by returning the same mock for every region and role.
+func (mc *MockELBClient) ELBClient(region string, role *config.Role) ELBClient {
+	return mc
+}
+
+// SetTargetHealth sets the state of the target in the target group, registering it if needed.
+func (mc *MockELBClient) SetTargetHealth(targetGroupArn, id string, port int32, state elbtypes.TargetHealthStateEnum) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	targets := mc.targetGroups[targetGroupArn]
+	for i, d := range targets {
+		if *d.Target.Id == id && *d.Target.Port == port {
+			targets[i].TargetHealth.State = state
+			return
+		}
+	}
+	mc.targetGroups[targetGroupArn] = append(targets, elbtypes.TargetHealthDescription{
+		Target:       &elbtypes.TargetDescription{Id: aws.String(id), Port: aws.Int32(port)},
+		TargetHealth: &elbtypes.TargetHealth{State: state},
+	})
+}
+
+// DeregisterTarget removes the target from the target group.
+func (mc *MockELBClient) DeregisterTarget(targetGroupArn, id string, port int32) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	var targets []elbtypes.TargetHealthDescription
+	for _, d := range mc.targetGroups[targetGroupArn] {
+		if *d.Target.Id != id || *d.Target.Port != port {
+			targets = append(targets, d)
+		}
+	}
+	mc.targetGroups[targetGroupArn] = targets
+}
+
+func (mc *MockELBClient) DescribeTargetHealth(ctx context.Context, params *elb.DescribeTargetHealthInput, optFns ...func(*elb.Options)) (*elb.DescribeTargetHealthOutput, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	targets, ok := mc.targetGroups[*params.TargetGroupArn]
+	if !ok {
+		return nil, errors.New("target group not found")
+	}
+	// Copy so the caller doesn't see later changes
+	descriptions := make([]elbtypes.TargetHealthDescription, len(targets))
+	for i, d := range targets {
+		health := *d.TargetHealth
+		descriptions[i] = elbtypes.TargetHealthDescription{Target: d.Target, TargetHealth: &health}
+	}
+	return &elb.DescribeTargetHealthOutput{TargetHealthDescriptions: descriptions}, nil
+}
+
+// CloudWatch mocks
+
+type mockAlarm struct {
+	state     cwtypes.StateValue
+	updatedAt time.Time
+}
+
+type MockCloudWatchClient struct {
+	mu     sync.Mutex
+	alarms map[string]*mockAlarm
+}
+
+// NewMockCloudWatchClient creates a mock with the given metric alarms, all in the OK state.
+func NewMockCloudWatchClient(alarmNames []string) *MockCloudWatchClient {
+	alarms := make(map[string]*mockAlarm)
+	for _, name := range alarmNames {
+		alarms[name] = &mockAlarm{state: cwtypes.StateValueOk, updatedAt: time.Now()}
+	}
+
+	return &MockCloudWatchClient{
+		alarms: alarms,
+	}
+}
+
+// CWClient implements CWClientProvider by returning the same mock for every region and role.
+func (mc *MockCloudWatchClient) CWClient(region string, role *config.Role) CWClient {
+	return mc
+}
+
+// SetAlarmState changes the state of the alarm as of now.
+func (mc *MockCloudWatchClient) SetAlarmState(name string, state cwtypes.StateValue) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	a, ok := mc.alarms[name]
+	if !ok {
+		panic(fmt.Sprintf("mock CloudWatch alarm %s not found", name))
+	}
+	a.state = state
+	a.updatedAt = time.Now()
+}
+
+func (mc *MockCloudWatchClient) DescribeAlarms(ctx context.Context, params *cloudwatch.DescribeAlarmsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.DescribeAlarmsOutput, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	var alarms []cwtypes.MetricAlarm
+	for _, name := range params.AlarmNames {
+		a, ok := mc.alarms[name]
+		if !ok {
+			// CloudWatch ignores alarms that don't exist
+			continue
+		}
+		alarms = append(alarms, cwtypes.MetricAlarm{
+			AlarmName:             aws.String(name),
+			StateValue:            a.state,
+			StateReason:           aws.String("Threshold Crossed"),
+			StateUpdatedTimestamp: aws.Time(a.updatedAt),
+		})
+	}
+	return &cloudwatch.DescribeAlarmsOutput{MetricAlarms: alarms}, nil
+}
+
+// CodeDeploy mocks
+
+type mockDeployment struct {
+	status             cdtypes.DeploymentStatus
+	rollbackDeployment string
+}
+
+// MockCodeDeployClient deploys services of a MockECSClient that use the CODE_DEPLOY deployment controller.
+type MockCodeDeployClient struct {
+	ecsClient *MockECSClient
+	mu        sync.Mutex
+	// Status new deployments end up in
+	nextStatus  cdtypes.DeploymentStatus
+	deployments map[string]*mockDeployment
+}
+
+func NewMockCodeDeployClient(ecsClient *MockECSClient) *MockCodeDeployClient {
+	return &MockCodeDeployClient{
+		ecsClient:   ecsClient,
+		nextStatus:  cdtypes.DeploymentStatusSucceeded,
+		deployments: make(map[string]*mockDeployment),
+	}
+}
+
+// CDClient implements CDClientProvider by returning the same mock for every region and role.
+func (mc *MockCodeDeployClient) CDClient(region string, role *config.Role) CDClient {
+	return mc
+}
+
+// SetDeploymentStatus sets the status new deployments end up in. Deployments that succeed
+// switch the task set of the service immediately, ones that fail are rolled back by CodeDeploy.
+func (mc *MockCodeDeployClient) SetDeploymentStatus(status cdtypes.DeploymentStatus) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.nextStatus = status
+}
+
+func (mc *MockCodeDeployClient) CreateDeployment(ctx context.Context, params *codedeploy.CreateDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.CreateDeploymentOutput, error) {
+	var spec appSpec
+	if err := json.Unmarshal([]byte(*params.Revision.AppSpecContent.Content), &spec); err != nil {
+		return nil, err
+	}
+	taskDefArn := spec.Resources[0].TargetService.Properties.TaskDefinition
+	service, _ := mc.ecsClient.findRevision(taskDefArn)
+	if service == nil {
+		return nil, errors.New("task definition not found")
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, d := range mc.deployments {
+		switch d.status {
+		case cdtypes.DeploymentStatusSucceeded, cdtypes.DeploymentStatusFailed, cdtypes.DeploymentStatusStopped:
+		default:
+			return nil, errors.New("deployment group already has an active deployment")
+		}
+	}
+
+	id := fmt.Sprintf("d-%d", len(mc.deployments)+1)
+	deployment := &mockDeployment{status: mc.nextStatus}
+	mc.deployments[id] = deployment
+	switch deployment.status {
+	case cdtypes.DeploymentStatusSucceeded:
+		mc.ecsClient.mu.Lock()
+		service.taskSetTaskDef = taskDefArn
+		mc.ecsClient.replaceTasks(service.taskSetCluster, service.name, taskDefArn)
+		mc.ecsClient.mu.Unlock()
+	case cdtypes.DeploymentStatusFailed:
+		// CodeDeploy rolls back to the original task set which is still running
+		deployment.rollbackDeployment = fmt.Sprintf("d-%d", len(mc.deployments)+1)
+		mc.deployments[deployment.rollbackDeployment] = &mockDeployment{status: cdtypes.DeploymentStatusSucceeded}
+	}
+	return &codedeploy.CreateDeploymentOutput{DeploymentId: aws.String(id)}, nil
+}
+
+func (mc *MockCodeDeployClient) GetDeployment(ctx context.Context, params *codedeploy.GetDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.GetDeploymentOutput, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	d, ok := mc.deployments[*params.DeploymentId]
+	if !ok {
+		return nil, errors.New("deployment not found")
+	}
+	info := &cdtypes.DeploymentInfo{
+		DeploymentId: params.DeploymentId,
+		Status:       d.status,
+	}
+	if d.status == cdtypes.DeploymentStatusFailed {
+		info.ErrorInformation = &cdtypes.ErrorInformation{
+			Code:    "ECS_UPDATE_ERROR",
+			Message: aws.String("The ECS service failed to stabilize"),
+		}
+	}
+	if d.rollbackDeployment != "" {
+		info.RollbackInfo = &cdtypes.RollbackInfo{RollbackDeploymentId: aws.String(d.rollbackDeployment)}
+	}
+	return &codedeploy.GetDeploymentOutput{DeploymentInfo: info}, nil
+}
+
+// StopDeployment stops the deployment, the original task set is left running.
+func (mc *MockCodeDeployClient) StopDeployment(ctx context.Context, params *codedeploy.StopDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.StopDeploymentOutput, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	d, ok := mc.deployments[*params.DeploymentId]
+	if !ok {
+		return nil, errors.New("deployment not found")
+	}
+	d.status = cdtypes.DeploymentStatusStopped
+	return &codedeploy.StopDeploymentOutput{Status: cdtypes.StopStatusSucceeded}, nil
+}
+
+// CloudWatch Logs mocks
+
+type MockLogsClient struct {
+	mu sync.Mutex
+	// Log lines by group and stream, oldest first
+	streams map[string][]string
+	// Regions clients were requested for
+	regions []string
+}
+
+func NewMockLogsClient() *MockLogsClient {
+	return &MockLogsClient{
+		streams: make(map[string][]string),
+	}
+}
+
+// LogsClient implements LogsClientProvider by returning the same mock for every region and role.
+func (mc *MockLogsClient) LogsClient(region string, role *config.Role) LogsClient {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.regions = append(mc.regions, region)
+	return mc
+}
+
+// Regions returns the region of each client requested, in order.
+func (mc *MockLogsClient) Regions() []string {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	return append([]string(nil), mc.regions...)
+}
+
+// AddLogLines appends the lines to the log stream, creating it if needed.
+func (mc *MockLogsClient) AddLogLines(group, stream string, lines ...string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	key := group + ":" + stream
+	mc.streams[key] = append(mc.streams[key], lines...)
+}
+
+func (mc *MockLogsClient) GetLogEvents(ctx context.Context, params *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	lines, ok := mc.streams[*params.LogGroupName+":"+*params.LogStreamName]
+	if !ok {
+		return nil, &logstypes.ResourceNotFoundException{Message: aws.String("The specified log stream does not exist.")}
+	}
+	if params.Limit != nil && len(lines) > int(*params.Limit) {
+		if aws.ToBool(params.StartFromHead) {
+			lines = lines[:*params.Limit]
+		} else {
+			lines = lines[len(lines)-int(*params.Limit):]
+		}
+	}
+
+	var events []logstypes.OutputLogEvent
+	for _, line := range lines {
+		events = append(events, logstypes.OutputLogEvent{Message: aws.String(line)})
+	}
+	return &cloudwatchlogs.GetLogEventsOutput{Events: events}, nil
+}
+
 // Event Bridge mocks
 
 type mockScheduledTask struct {
@@ -229,6 +977,11 @@ func NewMockEventBridgeClient(taskNames []string) *MockEventBridgeClient {
 	}
 }
 
+// EBClient implements EBClientProvider by returning the same mock for every region and role.
+func (mc *MockEventBridgeClient) EBClient(region string, role *config.Role) EBClient {
+	return mc
+}
+
 func (mc *MockEventBridgeClient) ListTargetsByRule(ctx context.Context, params *eventbridge.ListTargetsByRuleInput, optFns ...func(*eventbridge.Options)) (*eventbridge.ListTargetsByRuleOutput, error) {
 	t, ok := mc.tasks[*params.Rule]
 	if !ok {
@@ -0,0 +1,143 @@
+package awsecs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/TouchBistro/gehen/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/pkg/errors"
+)
+
+// ContainerPlan describes how a container in a task definition will be updated.
+type ContainerPlan struct {
+	Name string
+	// The image the container currently uses.
+	Image string
+	// The image the container will use. Same as Image if the container will not be changed.
+	NewImage string
+	// Skipped is true if the container will not be updated because it is not
+	// one of the containers listed in the config.
+	Skipped bool
+}
+
+// TaskDefPlan describes the changes that will be made to a task definition during a deploy.
+type TaskDefPlan struct {
+	// The task definition currently in use.
+	CurrentTaskDefinitionARN string
+	// The task definition the new revision will be based on. This may differ from
+	// CurrentTaskDefinitionARN if UpdateStrategyLatest is used.
+	BaseTaskDefinitionARN string
+	PreviousGitsha        string
+	Containers            []ContainerPlan
+	// NewRevision is true if a new task definition revision will be registered.
+	NewRevision bool
+}
+
+// PlanDeploy determines the changes Deploy would make to the task definition of the service
+// without registering a new task definition or updating the service.
+func PlanDeploy(ctx context.Context, service *config.Service, ecsClient ECSClient) (TaskDefPlan, error) {
+	respDescribeServices, err := ecsClient.DescribeServices(ctx, &ecs.DescribeServicesInput{
+		Services: []string{service.Name},
+		Cluster:  &service.Cluster,
+	})
+	if err != nil {
+		return TaskDefPlan{}, errors.Wrapf(err, "failed to find service: %s", service.Name)
+	}
+	if len(respDescribeServices.Services) != 1 {
+		return TaskDefPlan{}, errors.Errorf("expected 1 service named %s, got %d", service.Name, len(respDescribeServices.Services))
+	}
+
+	taskDefARN := *respDescribeServices.Services[0].TaskDefinition
+	plan, _, err := planTaskDef(ctx, taskDefARN, service.Gitsha, service.UpdateStrategy, service.Containers, ecsClient)
+	if err != nil {
+		return TaskDefPlan{}, errors.Wrapf(err, "failed to plan task def for service: %s", service.Name)
+	}
+	return plan, nil
+}
+
+// planTaskDef determines how the task def should be updated to use the new Git SHA.
+// It returns the plan along with the input required to register the new revision.
+// The input is not modified, it is up to the caller to apply the new images.
+func planTaskDef(ctx context.Context, taskDefARN, gitsha, updateStrategy string, containers []string, ecsClient ECSClient) (TaskDefPlan, ecs.RegisterTaskDefinitionInput, error) {
+	taskDefName := taskDefARN
+	if updateStrategy == config.UpdateStrategyLatest {
+		// If latest parse the family name from the ARN so we can look up the latest revision
+		family, err := taskDefFamily(taskDefARN)
+		if err != nil {
+			return TaskDefPlan{}, ecs.RegisterTaskDefinitionInput{}, err
+		}
+		taskDefName = family
+	}
+
+	// Use resolved resource info to grab existing task def
+	respDescribeTaskDef, err := ecsClient.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: &taskDefName,
+	})
+	if err != nil {
+		return TaskDefPlan{}, ecs.RegisterTaskDefinitionInput{}, errors.Wrapf(err, "failed to get task definition: %s", taskDefName)
+	}
+
+	// Convert API output to be ready to update task.
+	taskDef := respDescribeTaskDef.TaskDefinition
+	newTaskInput := ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions:    taskDef.ContainerDefinitions,
+		Cpu:                     taskDef.Cpu,
+		ExecutionRoleArn:        taskDef.ExecutionRoleArn,
+		Family:                  taskDef.Family,
+		IpcMode:                 taskDef.IpcMode,
+		Memory:                  taskDef.Memory,
+		NetworkMode:             taskDef.NetworkMode,
+		PidMode:                 taskDef.PidMode,
+		PlacementConstraints:    taskDef.PlacementConstraints,
+		ProxyConfiguration:      taskDef.ProxyConfiguration,
+		RequiresCompatibilities: taskDef.RequiresCompatibilities,
+		TaskRoleArn:             taskDef.TaskRoleArn,
+		Volumes:                 taskDef.Volumes,
+	}
+
+	plan := TaskDefPlan{
+		CurrentTaskDefinitionARN: taskDefARN,
+		BaseTaskDefinitionARN:    *taskDef.TaskDefinitionArn,
+		Containers:               make([]ContainerPlan, len(taskDef.ContainerDefinitions)),
+	}
+
+	containersToUpdate := make(map[string]bool)
+	for _, c := range containers {
+		containersToUpdate[c] = true
+	}
+
+	for i, containerDef := range taskDef.ContainerDefinitions {
+		containerPlan := ContainerPlan{Image: *containerDef.Image, NewImage: *containerDef.Image}
+		if containerDef.Name != nil {
+			containerPlan.Name = *containerDef.Name
+		}
+
+		// If service config does not specify which containers to update, we update all containers
+		// in that task def.
+		if len(containersToUpdate) != 0 && !containersToUpdate[containerPlan.Name] {
+			containerPlan.Skipped = true
+			plan.Containers[i] = containerPlan
+			continue
+		}
+
+		// Images have the form <repo-url>/<image>:<tag>
+		t := strings.Split(containerPlan.Image, ":")
+
+		if plan.PreviousGitsha == "" {
+			// Tag is the last element which is the SHA
+			plan.PreviousGitsha = t[len(t)-1]
+		}
+
+		// Only update if we find an existing image that is different from the new gitsha
+		if gitsha != plan.PreviousGitsha && updateStrategy != config.UpdateStrategyRedeploy {
+			plan.NewRevision = true
+			// Get new image by using new SHA
+			containerPlan.NewImage = fmt.Sprintf("%s:%s", strings.Join(t[:len(t)-1], ""), gitsha)
+		}
+		plan.Containers[i] = containerPlan
+	}
+
+	return plan, newTaskInput, nil
+}
@@ -0,0 +1,65 @@
+package awsecs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+const (
+	// DefaultMaxRetries is how many times a failed AWS request is retried if the error is retryable.
+	DefaultMaxRetries = 5
+	// maxRetryBackoff is the longest delay between retries of an AWS request.
+	maxRetryBackoff = 20 * time.Second
+)
+
+// IsRetryable reports whether err is a transient AWS error, such as throttling or a 5xx response,
+// that may succeed if the request is made again. All other errors, such as missing permissions
+// or resources, are permanent.
+func IsRetryable(err error) bool {
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// NewRetryer returns a function that creates the retryer used by AWS clients. Requests that fail with
+// a retryable error are retried up to maxRetries times with exponential backoff and jitter.
+// Each retry is logged.
+func NewRetryer(maxRetries int) func() aws.Retryer {
+	return func() aws.Retryer {
+		return loggingRetryer{retry.NewStandard(func(o *retry.StandardOptions) {
+			// MaxAttempts includes the first attempt
+			o.MaxAttempts = maxRetries + 1
+			o.MaxBackoff = maxRetryBackoff
+			// The default rate limiter stops retrying once too many requests of a client fail.
+			// Services share clients so throttling while checking many services would
+			// use up the quota of all of them.
+			o.RateLimiter = noRateLimit{}
+		})}
+	}
+}
+
+// loggingRetryer logs each retry of a request.
+type loggingRetryer struct {
+	aws.Retryer
+}
+
+func (r loggingRetryer) RetryDelay(attempt int, err error) (time.Duration, error) {
+	delay, delayErr := r.Retryer.RetryDelay(attempt, err)
+	if delayErr == nil {
+		log.Printf("Retrying AWS request in %s (retry %d of %d): %v\n", delay.Round(time.Millisecond), attempt, r.MaxAttempts()-1, err)
+	}
+	return delay, delayErr
+}
+
+// noRateLimit is a retry.RateLimiter that allows every retry.
+type noRateLimit struct{}
+
+func (noRateLimit) GetToken(ctx context.Context, cost uint) (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+func (noRateLimit) AddTokens(uint) error {
+	return nil
+}
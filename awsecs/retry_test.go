@@ -0,0 +1,87 @@
+package awsecs_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/TouchBistro/gehen/awsecs"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+// sendRequest sends a request through the retry middleware used by AWS clients.
+// Every attempt fails with err. It returns the number of attempts made and the log output.
+func sendRequest(maxRetries int, err error) (int, string, error) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	attempts := 0
+	attempt := retry.NewAttemptMiddleware(awsecs.NewRetryer(maxRetries)(), func(r interface{}) interface{} { return r })
+	_, _, reqErr := attempt.HandleFinalize(
+		context.Background(),
+		middleware.FinalizeInput{},
+		middleware.FinalizeHandlerFunc(func(ctx context.Context, in middleware.FinalizeInput) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			attempts++
+			return middleware.FinalizeOutput{}, middleware.Metadata{}, err
+		}),
+	)
+	return attempts, logs.String(), reqErr
+}
+
+func TestRetryerMaxRetries(t *testing.T) {
+	throttled := &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+
+	attempts, logs, err := sendRequest(2, throttled)
+
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, throttled))
+	// The first attempt and 2 retries
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 2, strings.Count(logs, "Retrying AWS request"))
+	assert.Contains(t, logs, "(retry 1 of 2)")
+	assert.Contains(t, logs, "(retry 2 of 2)")
+	assert.Contains(t, logs, "Rate exceeded")
+}
+
+func TestRetryerNoRetries(t *testing.T) {
+	throttled := &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+
+	attempts, logs, err := sendRequest(0, throttled)
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+	assert.Empty(t, logs)
+}
+
+func TestRetryerPermanentError(t *testing.T) {
+	denied := &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized"}
+
+	attempts, logs, err := sendRequest(5, denied)
+
+	assert.Equal(t, denied, err)
+	assert.Equal(t, 1, attempts)
+	assert.Empty(t, logs)
+	assert.False(t, awsecs.IsRetryable(denied))
+}
+
+func TestRetryerNoRateLimit(t *testing.T) {
+	throttled := &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	retryer := awsecs.NewRetryer(awsecs.DefaultMaxRetries)()
+
+	// The default rate limiter runs out of tokens after 100 retries
+	for i := 0; i < 200; i++ {
+		// Every retry fails again so no tokens are returned
+		_, err := retryer.GetRetryToken(context.Background(), throttled)
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package awsecs
+
+import (
+	"context"
+	"strings"
+
+	"github.com/TouchBistro/gehen/config"
+	"github.com/pkg/errors"
+)
+
+// PrepareRollback sets up the service so that it will be rolled back to the given
+// revision by UpdateService once the current and previous values are swapped.
+//
+// to can be one of:
+//   - a task definition ARN or family:revision, which must belong to the family the service is using
+//   - a Git SHA, in which case the newest revision using that Git SHA is used
+//   - empty, in which case the revision immediately preceding the current one is used
+//
+// When searching for a revision at most maxRevisions of the newest revisions are looked at,
+// since each one requires a call to DescribeTaskDefinition.
+func PrepareRollback(ctx context.Context, service *config.Service, to string, maxRevisions int, ecsClient ECSClient) error {
+	status, err := GetServiceStatus(ctx, service, ecsClient)
+	if err != nil {
+		return err
+	}
+
+	current := status.TaskDefinition
+	var target TaskDefRevision
+	switch {
+	case to == "":
+		target, err = findRevision(ctx, current, maxRevisions, ecsClient, func(r TaskDefRevision) bool {
+			return r.Revision < current.Revision
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to find the revision before %s", current.ARN)
+		}
+	case strings.Contains(to, ":"):
+		// Git SHAs never contain a colon so this must be a task definition
+		target, err = DescribeRevision(ctx, to, ecsClient)
+		if err != nil {
+			return err
+		}
+		if target.Family != current.Family {
+			return errors.Errorf("task definition %s does not belong to family %s used by service %s", target.ARN, current.Family, service.Name)
+		}
+	default:
+		target, err = findRevision(ctx, current, maxRevisions, ecsClient, func(r TaskDefRevision) bool {
+			return r.Gitsha(service.Containers) == to
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to find a revision of %s using gitsha %s", current.Family, to)
+		}
+	}
+
+	if target.ARN == current.ARN {
+		return errors.Errorf("service %s is already using %s", service.Name, current.ARN)
+	}
+
+	// Rolling back swaps the current and previous values so treat the target as the previous version
+	service.Gitsha = current.Gitsha(service.Containers)
+	service.TaskDefinitionARN = current.ARN
+	service.PreviousGitsha = target.Gitsha(service.Containers)
+	service.PreviousTaskDefinitionARN = target.ARN
+	return nil
+}
+
+// findRevision returns the newest revision in the family of current that matches.
+// Only the newest maxRevisions revisions are searched.
+func findRevision(ctx context.Context, current TaskDefRevision, maxRevisions int, ecsClient ECSClient, match func(TaskDefRevision) bool) (TaskDefRevision, error) {
+	var found *TaskDefRevision
+	searched := 0
+	err := walkRevisions(ctx, current.ARN, ecsClient, func(r TaskDefRevision) bool {
+		searched++
+		if match(r) {
+			found = &r
+			return false
+		}
+		return searched < maxRevisions
+	})
+	if err != nil {
+		return TaskDefRevision{}, err
+	}
+	if found == nil {
+		return TaskDefRevision{}, errors.Errorf("no matching revision in the newest %d revisions", searched)
+	}
+	return *found, nil
+}
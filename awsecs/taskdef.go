@@ -0,0 +1,195 @@
+package awsecs
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/TouchBistro/gehen/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/pkg/errors"
+)
+
+var taskDefARNRegexp = regexp.MustCompile(`arn:aws:ecs:[^:\n]*:[^:\n]*:task-definition\/([^:\n]*):\d+`)
+
+// ContainerImage is the image used by a container in a task definition.
+type ContainerImage struct {
+	Name  string
+	Image string
+}
+
+// Tag returns the tag of the image, which is the Git SHA for images deployed by gehen.
+func (c ContainerImage) Tag() string {
+	t := strings.Split(c.Image, ":")
+	return t[len(t)-1]
+}
+
+// TaskDefRevision represents a revision of a task definition.
+type TaskDefRevision struct {
+	ARN        string
+	Family     string
+	Revision   int32
+	Containers []ContainerImage
+}
+
+// Gitsha returns the Git SHA the revision is using. It is determined from the image tag
+// of the first container, or the first of the given containers if any are provided.
+func (r TaskDefRevision) Gitsha(containers []string) string {
+	for _, c := range r.Containers {
+		if UpdatesContainer(containers, c.Name) {
+			return c.Tag()
+		}
+	}
+	return ""
+}
+
+// DescribeRevision returns the revision of the given task definition.
+// taskDef can be a full ARN, family:revision or just the family to get the latest revision.
+func DescribeRevision(ctx context.Context, taskDef string, ecsClient ECSClient) (TaskDefRevision, error) {
+	resp, err := ecsClient.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: &taskDef,
+	})
+	if err != nil {
+		return TaskDefRevision{}, errors.Wrapf(err, "failed to get task definition: %s", taskDef)
+	}
+	return newTaskDefRevision(resp.TaskDefinition), nil
+}
+
+// ListRevisions returns the most recent revisions of the task definition family of taskDefARN,
+// newest first. At most limit revisions are returned.
+func ListRevisions(ctx context.Context, taskDefARN string, limit int, ecsClient ECSClient) ([]TaskDefRevision, error) {
+	var revisions []TaskDefRevision
+	err := walkRevisions(ctx, taskDefARN, ecsClient, func(revision TaskDefRevision) bool {
+		revisions = append(revisions, revision)
+		return len(revisions) < limit
+	})
+	return revisions, err
+}
+
+// walkRevisions calls fn with each revision of the task definition family of taskDefARN,
+// newest first, until fn returns false or there are no revisions left.
+func walkRevisions(ctx context.Context, taskDefARN string, ecsClient ECSClient, fn func(TaskDefRevision) bool) error {
+	family, err := taskDefFamily(taskDefARN)
+	if err != nil {
+		return err
+	}
+
+	var nextToken *string
+	for {
+		resp, err := ecsClient.ListTaskDefinitions(ctx, &ecs.ListTaskDefinitionsInput{
+			FamilyPrefix: &family,
+			Sort:         ecstypes.SortOrderDesc,
+			NextToken:    nextToken,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to list task definitions for family: %s", family)
+		}
+
+		for _, arn := range resp.TaskDefinitionArns {
+			// FamilyPrefix is a prefix match so other families could be included
+			if f, err := taskDefFamily(arn); err != nil || f != family {
+				continue
+			}
+
+			revision, err := DescribeRevision(ctx, arn, ecsClient)
+			if err != nil {
+				return err
+			}
+			if !fn(revision) {
+				return nil
+			}
+		}
+
+		nextToken = resp.NextToken
+		if nextToken == nil {
+			return nil
+		}
+	}
+}
+
+// ServiceStatus represents what is currently running for a service in ECS.
+type ServiceStatus struct {
+	TaskDefinition TaskDefRevision
+	Deployments    []DeploymentStatus
+}
+
+// DeploymentStatus represents an ECS deployment of a service.
+type DeploymentStatus struct {
+	TaskDefinitionARN string
+	Status            string
+	DesiredCount      int32
+	RunningCount      int32
+	PendingCount      int32
+}
+
+// GetServiceStatus returns the current task definition and deployments of the service.
+func GetServiceStatus(ctx context.Context, service *config.Service, ecsClient ECSClient) (ServiceStatus, error) {
+	respDescribeServices, err := ecsClient.DescribeServices(ctx, &ecs.DescribeServicesInput{
+		Services: []string{service.Name},
+		Cluster:  &service.Cluster,
+	})
+	if err != nil {
+		return ServiceStatus{}, errors.Wrapf(err, "failed to get service: %s", service.Name)
+	}
+	if len(respDescribeServices.Services) != 1 {
+		return ServiceStatus{}, errors.Errorf("expected 1 service named %s, got %d", service.Name, len(respDescribeServices.Services))
+	}
+
+	awsService := respDescribeServices.Services[0]
+	revision, err := DescribeRevision(ctx, *awsService.TaskDefinition, ecsClient)
+	if err != nil {
+		return ServiceStatus{}, err
+	}
+
+	status := ServiceStatus{TaskDefinition: revision}
+	for _, d := range awsService.Deployments {
+		status.Deployments = append(status.Deployments, DeploymentStatus{
+			TaskDefinitionARN: aws.ToString(d.TaskDefinition),
+			Status:            aws.ToString(d.Status),
+			DesiredCount:      d.DesiredCount,
+			RunningCount:      d.RunningCount,
+			PendingCount:      d.PendingCount,
+		})
+	}
+	return status, nil
+}
+
+// taskDefFamily parses the task definition family from the ARN.
+func taskDefFamily(taskDefARN string) (string, error) {
+	matches := taskDefARNRegexp.FindStringSubmatch(taskDefARN)
+	if matches == nil {
+		return "", errors.Errorf("unable to parse task def family: %s", taskDefARN)
+	}
+	return matches[1], nil
+}
+
+func newTaskDefRevision(taskDef *ecstypes.TaskDefinition) TaskDefRevision {
+	revision := TaskDefRevision{
+		ARN:      aws.ToString(taskDef.TaskDefinitionArn),
+		Family:   aws.ToString(taskDef.Family),
+		Revision: taskDef.Revision,
+	}
+	for _, c := range taskDef.ContainerDefinitions {
+		revision.Containers = append(revision.Containers, ContainerImage{
+			Name:  aws.ToString(c.Name),
+			Image: aws.ToString(c.Image),
+		})
+	}
+	return revision
+}
+
+// UpdatesContainer reports whether gehen updates the named container given the
+// containers listed in the config. All containers are updated if none are listed.
+func UpdatesContainer(containers []string, name string) bool {
+	if len(containers) == 0 {
+		return true
+	}
+	for _, c := range containers {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package awsecs
+
+import (
+	"context"
+	"log"
+
+	"github.com/TouchBistro/gehen/config"
+	"github.com/TouchBistro/goutils/color"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/pkg/errors"
+)
+
+// CheckTasksDeployed verifies a deployment using the state of the service's tasks in ECS.
+// It returns true once every running task uses service.TaskDefinitionARN, the containers
+// gehen updates run images tagged with service.Gitsha and every container with a health
+// check is healthy. It is used to check services that have no URL or other deploy check.
+// If service.TaskDefinitionARN is not set, like for services gehen doesn't deploy, the task
+// definition the service is currently using is checked instead.
+func CheckTasksDeployed(ctx context.Context, service *config.Service, ecsClient ECSClient) (bool, error) {
+	taskDefARN := service.TaskDefinitionARN
+	if taskDefARN == "" {
+		var err error
+		if taskDefARN, err = currentTaskDefinition(ctx, service, ecsClient); err != nil {
+			return false, err
+		}
+	}
+
+	respTaskDef, err := ecsClient.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: &taskDefARN,
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get task definition: %s", taskDefARN)
+	}
+	healthChecked := make(map[string]bool)
+	for _, c := range respTaskDef.TaskDefinition.ContainerDefinitions {
+		healthChecked[aws.ToString(c.Name)] = c.HealthCheck != nil
+	}
+
+	tasks, err := describeServiceTasks(ctx, service, ecstypes.DesiredStatusRunning, ecsClient)
+	if err != nil {
+		return false, err
+	}
+	if len(tasks) == 0 {
+		log.Printf("No running tasks found for %s\n", color.Cyan(service.Name))
+		return false, nil
+	}
+
+	ready := 0
+	for _, task := range tasks {
+		if taskReady(task, service, taskDefARN, healthChecked) {
+			ready++
+		}
+	}
+
+	log.Printf(
+		"%d of %d tasks of %s running version %s and healthy\n",
+		ready,
+		len(tasks),
+		color.Cyan(service.Name),
+		color.Magenta(service.Gitsha),
+	)
+	return ready == len(tasks), nil
+}
+
+// taskReady reports whether the task is running the new version of the service and is healthy.
+// healthChecked holds whether each container of taskDefARN has a health check.
+func taskReady(task ecstypes.Task, service *config.Service, taskDefARN string, healthChecked map[string]bool) bool {
+	if aws.ToString(task.TaskDefinitionArn) != taskDefARN {
+		return false
+	}
+	if aws.ToString(task.LastStatus) != string(ecstypes.DesiredStatusRunning) {
+		return false
+	}
+
+	for _, c := range task.Containers {
+		name := aws.ToString(c.Name)
+		image := ContainerImage{Name: name, Image: aws.ToString(c.Image)}
+		if UpdatesContainer(service.Containers, name) && image.Tag() != service.Gitsha {
+			return false
+		}
+		if healthChecked[name] && c.HealthStatus != ecstypes.HealthStatusHealthy {
+			return false
+		}
+	}
+	return true
+}
+
+// currentTaskDefinition returns the task definition the service is currently using in ECS.
+func currentTaskDefinition(ctx context.Context, service *config.Service, ecsClient ECSClient) (string, error) {
+	respDescribeServices, err := ecsClient.DescribeServices(ctx, &ecs.DescribeServicesInput{
+		Services: []string{service.Name},
+		Cluster:  &service.Cluster,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get service: %s", service.Name)
+	}
+	if len(respDescribeServices.Services) != 1 {
+		return "", errors.Errorf("expected 1 service named %s, got %d", service.Name, len(respDescribeServices.Services))
+	}
+	return aws.ToString(respDescribeServices.Services[0].TaskDefinition), nil
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"github.com/pkg/errors"
+)
+
+type canaryConfig struct {
+	Service     string           `yaml:"service"`
+	Cluster     string           `yaml:"cluster"`
+	URL         string           `yaml:"url"`
+	URLs        []string         `yaml:"urls"`
+	Quorum      string           `yaml:"quorum"`
+	Check       checkConfig      `yaml:"check"`
+	Alarms      []string         `yaml:"alarms"`
+	BakeMinutes int              `yaml:"bakeMinutes"`
+	CodeDeploy  codeDeployConfig `yaml:"codeDeploy"`
+}
+
+// parseCanary returns the canary of the service with the given name and config.
+// The canary uses the same settings as the service except for its deploy check,
+// alarms, bake period and CodeDeploy deployment group. The cluster and bake period default to the service's.
+func parseCanary(name string, s serviceConfig, config gehenConfig, role *Role, updateStrategy, gitsha, configDir string) (*Service, error) {
+	c := s.Canary
+	if c.Service == "" {
+		return nil, errors.Errorf("config: service %s: canary.service must be set", name)
+	}
+	if c.Service == name {
+		return nil, errors.Errorf("config: service %s cannot be its own canary", name)
+	}
+
+	canaryConfig := s
+	canaryConfig.Canary = nil
+	if c.Cluster != "" {
+		canaryConfig.Cluster = c.Cluster
+	}
+	canaryConfig.URL = c.URL
+	canaryConfig.URLs = c.URLs
+	canaryConfig.Quorum = c.Quorum
+	canaryConfig.Check = c.Check
+	canaryConfig.Alarms = c.Alarms
+	canaryConfig.CodeDeploy = c.CodeDeploy
+	if c.BakeMinutes != 0 {
+		canaryConfig.BakeMinutes = c.BakeMinutes
+	}
+
+	canary, err := parseService(c.Service, canaryConfig, config, role, updateStrategy, gitsha, configDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "canary of service %s", name)
+	}
+	return canary, nil
+}
+
+// checkCanaryNames makes sure every canary has a unique name that isn't used by a service.
+func checkCanaryNames(services, canaries []*Service) error {
+	names := make(map[string]bool)
+	for _, s := range services {
+		names[s.Name] = true
+	}
+	for _, c := range canaries {
+		if names[c.Name] {
+			return errors.Errorf("config: canary %s is already defined as a service or canary", c.Name)
+		}
+		names[c.Name] = true
+	}
+	return nil
+}
+
+// addCanaryStages inserts a canary stage before each stage with services that have canaries.
+// A canary stage is named after the stage it comes before, with a "-canary" suffix.
+func addCanaryStages(stages []*Stage) []*Stage {
+	var withCanaries []*Stage
+	for _, stage := range stages {
+		var canaries []*Service
+		for _, s := range stage.Services {
+			if s.Canary != nil {
+				canaries = append(canaries, s.Canary)
+			}
+		}
+		if len(canaries) > 0 {
+			name := "canary"
+			if stage.Name != "" {
+				name = stage.Name + "-canary"
+			}
+			withCanaries = append(withCanaries, &Stage{Name: name, Services: canaries, Canary: true})
+		}
+		withCanaries = append(withCanaries, stage)
+	}
+	return withCanaries
+}
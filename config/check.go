@@ -0,0 +1,249 @@
+package config
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TouchBistro/goutils/file"
+	"github.com/pkg/errors"
+)
+
+type checkConfig struct {
+	Header             string            `yaml:"header"`
+	Regex              string            `yaml:"regex"`
+	JSONPointer        string            `yaml:"jsonPointer"`
+	Method             string            `yaml:"method"`
+	Headers            map[string]string `yaml:"headers"`
+	TimeoutSeconds     int               `yaml:"timeoutSeconds"`
+	CABundle           string            `yaml:"caBundle"`
+	InsecureSkipVerify bool              `yaml:"insecureSkipVerify"`
+	SuccessThreshold   int               `yaml:"successThreshold"`
+	NoOldVersionInLast int               `yaml:"noOldVersionInLast"`
+	TCP                string            `yaml:"tcp"`
+	GRPC               *grpcCheckConfig  `yaml:"grpc"`
+	Command            []string          `yaml:"command"`
+}
+
+type grpcCheckConfig struct {
+	Address         string `yaml:"address"`
+	Service         string `yaml:"service"`
+	VersionMetadata string `yaml:"versionMetadata"`
+	TLS             bool   `yaml:"tls"`
+}
+
+// probes returns the names of the non-HTTP deploy checks that are set.
+func (c checkConfig) probes() []string {
+	var probes []string
+	if c.TCP != "" {
+		probes = append(probes, "tcp")
+	}
+	if c.GRPC != nil {
+		probes = append(probes, "grpc")
+	}
+	if len(c.Command) > 0 {
+		probes = append(probes, "command")
+	}
+	return probes
+}
+
+// DefaultVersionMetadata is the gRPC metadata key the version is read from
+// if a gRPC deploy check doesn't set one.
+const DefaultVersionMetadata = "version"
+
+// Check configures how the deploy check finds the version a service is running
+// from the response of its URL. If no fields are set the version is read from the
+// Server header, falling back to the whole body.
+// Services without a URL can use one of TCP, GRPC or Command instead.
+type Check struct {
+	// The name of the header containing the version.
+	Header string
+	// A regex used to extract the version from the header or body.
+	// The version is the first capture group.
+	Regex *regexp.Regexp
+	// A JSON pointer (RFC 6901) to the version in a JSON body, ex: /version/commit
+	JSONPointer string
+	// The HTTP method of the request. If empty, GET is used.
+	Method string
+	// Headers to send with the request. Environment variables in the values
+	// have already been expanded.
+	Headers map[string]string
+	// How long to wait for a response to each request.
+	// If zero, the deploy package default is used.
+	Timeout time.Duration
+	// The path to a PEM file of CA certificates to trust in addition to the system ones.
+	// Relative paths in gehen.yml are resolved against the directory containing it.
+	CABundle string
+	// Disables TLS certificate verification.
+	InsecureSkipVerify bool
+	// How many checks in a row need to show the new version before it is considered deployed.
+	// If zero, a single check is enough.
+	SuccessThreshold int
+	// If set, none of this many of the most recent responses can show a version
+	// other than the new one before it is considered deployed.
+	NoOldVersionInLast int
+	// An address (host:port) that must accept TCP connections.
+	// No version can be read so it only checks that the service is reachable.
+	TCP string
+	// Checks the service using the gRPC health checking protocol.
+	GRPC *GRPCCheck
+	// A command to run, its stdout must contain the Git SHA being deployed.
+	// The first element is the program and the rest are its arguments.
+	Command []string
+}
+
+// GRPCCheck configures a deploy check using the gRPC health checking protocol.
+type GRPCCheck struct {
+	// The address (host:port) of the gRPC server.
+	Address string
+	// The name of the service to check the health of.
+	// If empty, the overall health of the server is checked.
+	Service string
+	// The response header metadata key containing the version.
+	VersionMetadata string
+	// Whether to connect using TLS. CABundle and InsecureSkipVerify also apply.
+	TLS bool
+}
+
+// parseCheck validates the check config and converts it to a Check.
+// A relative caBundle path is resolved against configDir, the directory of gehen.yml.
+func parseCheck(c checkConfig, configDir string) (Check, error) {
+	check := Check{
+		Header:             c.Header,
+		JSONPointer:        c.JSONPointer,
+		Method:             strings.ToUpper(c.Method),
+		Timeout:            time.Duration(c.TimeoutSeconds) * time.Second,
+		CABundle:           c.CABundle,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		SuccessThreshold:   c.SuccessThreshold,
+		NoOldVersionInLast: c.NoOldVersionInLast,
+	}
+
+	switch check.Method {
+	case "", http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	case http.MethodHead:
+		// Responses to HEAD requests have no body so the version must come from a header
+		if c.Header == "" {
+			return Check{}, errors.New("config: check.method HEAD requires check.header to be set since the response has no body")
+		}
+	default:
+		return Check{}, errors.Errorf("config: invalid check.method %q", c.Method)
+	}
+
+	if probes := c.probes(); len(probes) > 1 {
+		return Check{}, errors.Errorf("config: only one of check.%s can be set", strings.Join(probes, ", check."))
+	}
+	check.TCP = c.TCP
+	check.Command = c.Command
+	if c.GRPC != nil {
+		if c.GRPC.Address == "" {
+			return Check{}, errors.New("config: check.grpc.address must be set")
+		}
+		check.GRPC = &GRPCCheck{
+			Address:         c.GRPC.Address,
+			Service:         c.GRPC.Service,
+			VersionMetadata: strings.ToLower(c.GRPC.VersionMetadata),
+			TLS:             c.GRPC.TLS,
+		}
+		if check.GRPC.VersionMetadata == "" {
+			check.GRPC.VersionMetadata = DefaultVersionMetadata
+		}
+	}
+
+	if c.Header != "" && c.JSONPointer != "" {
+		return Check{}, errors.New("config: check.header and check.jsonPointer cannot both be set")
+	}
+	if c.JSONPointer != "" && !strings.HasPrefix(c.JSONPointer, "/") {
+		return Check{}, errors.Errorf("config: invalid check.jsonPointer %q, must start with /", c.JSONPointer)
+	}
+
+	if c.Regex != "" {
+		re, err := regexp.Compile(c.Regex)
+		if err != nil {
+			return Check{}, errors.Wrapf(err, "config: invalid check.regex %q", c.Regex)
+		}
+		if re.NumSubexp() < 1 {
+			return Check{}, errors.Errorf("config: invalid check.regex %q, must have a capture group", c.Regex)
+		}
+		check.Regex = re
+	}
+
+	if c.SuccessThreshold < 0 {
+		return Check{}, errors.Errorf("config: invalid check.successThreshold %d, must not be negative", c.SuccessThreshold)
+	}
+	if c.NoOldVersionInLast < 0 {
+		return Check{}, errors.Errorf("config: invalid check.noOldVersionInLast %d, must not be negative", c.NoOldVersionInLast)
+	}
+	if c.TimeoutSeconds < 0 {
+		return Check{}, errors.Errorf("config: invalid check.timeoutSeconds %d, must not be negative", c.TimeoutSeconds)
+	}
+	if c.CABundle != "" {
+		if !filepath.IsAbs(c.CABundle) {
+			check.CABundle = filepath.Join(configDir, c.CABundle)
+		}
+		if !file.Exists(check.CABundle) {
+			return Check{}, errors.Errorf("config: check.caBundle %s does not exist", check.CABundle)
+		}
+	}
+
+	if len(c.Headers) > 0 {
+		check.Headers = make(map[string]string, len(c.Headers))
+	}
+	for name, value := range c.Headers {
+		expanded, err := expandEnv(value)
+		if err != nil {
+			return Check{}, errors.Wrapf(err, "config: check.headers.%s", name)
+		}
+		check.Headers[name] = expanded
+	}
+	return check, nil
+}
+
+// expandEnv replaces ${var} or $var in s with the value of the environment variable.
+// Unlike os.ExpandEnv it is an error if a variable is not set, since that is
+// almost certainly a missing secret.
+func expandEnv(s string) (string, error) {
+	var missing []string
+	expanded := os.Expand(s, func(name string) string {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", errors.Errorf("environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+const (
+	// QuorumAll requires every URL of a service to show the new version.
+	QuorumAll = "all"
+	// QuorumAny requires a single URL of a service to show the new version.
+	QuorumAny = "any"
+)
+
+// parseQuorum validates the quorum for the given number of URLs and converts it
+// to the number of URLs that must show the new version. Zero means all of them.
+func parseQuorum(quorum string, numURLs int) (int, error) {
+	switch strings.ToLower(quorum) {
+	case QuorumAll, "":
+		return 0, nil
+	case QuorumAny:
+		return 1, nil
+	}
+
+	n, err := strconv.Atoi(quorum)
+	if err != nil || n < 1 || n > numURLs {
+		return 0, errors.Errorf(`config: invalid quorum %q, must be "all", "any" or a number between 1 and the number of urls`, quorum)
+	}
+	if n == numURLs {
+		return 0, nil
+	}
+	return n, nil
+}
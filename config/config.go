@@ -2,9 +2,12 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/TouchBistro/goutils/file"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
@@ -16,25 +19,63 @@ const (
 	UpdateStrategyNone     = "none"
 )
 
+const (
+	// OnCancelRollback rolls back all deployed services when a deploy is cancelled.
+	OnCancelRollback = "rollback"
+	// OnCancelLeave stops the deploy immediately and leaves services as they are.
+	OnCancelLeave = "leave"
+	// OnCancelWait waits for the current phase of the deploy to finish before stopping.
+	OnCancelWait = "wait"
+)
+
 type serviceConfig struct {
-	Cluster    string   `yaml:"cluster"`
-	URL        string   `yaml:"url"`
-	Containers []string `yaml:"containers"`
+	Cluster              string           `yaml:"cluster"`
+	URL                  string           `yaml:"url"`
+	URLs                 []string         `yaml:"urls"`
+	Quorum               string           `yaml:"quorum"`
+	Containers           []string         `yaml:"containers"`
+	UpdateStrategy       string           `yaml:"updateStrategy"`
+	TimeoutMinutes       int              `yaml:"timeoutMinutes"`
+	CheckIntervalSeconds int              `yaml:"checkIntervalSeconds"`
+	Role                 *Role            `yaml:"role"`
+	Stage                string           `yaml:"stage"`
+	Check                checkConfig      `yaml:"check"`
+	Alarms               []string         `yaml:"alarms"`
+	BakeMinutes          int              `yaml:"bakeMinutes"`
+	LogLines             int              `yaml:"logLines"`
+	Canary               *canaryConfig    `yaml:"canary"`
+	CodeDeploy           codeDeployConfig `yaml:"codeDeploy"`
 }
 
-type scheduledTaskConfig struct{}
+type codeDeployConfig struct {
+	Application     string `yaml:"application"`
+	DeploymentGroup string `yaml:"deploymentGroup"`
+}
+
+type scheduledTaskConfig struct {
+	Region string `yaml:"region"`
+	Role   *Role  `yaml:"role"`
+}
 
 type gehenConfig struct {
-	Services       map[string]serviceConfig       `yaml:"services"`
-	ScheduledTasks map[string]scheduledTaskConfig `yaml:"scheduledTasks"`
-	Role           Role                           `yaml:"role"`
-	TimeoutMinutes int                            `yaml:"timeoutMinutes"`
-	UpdateStrategy string                         `yaml:"updateStrategy"`
+	Services             map[string]serviceConfig       `yaml:"services"`
+	ScheduledTasks       map[string]scheduledTaskConfig `yaml:"scheduledTasks"`
+	Stages               []string                       `yaml:"stages"`
+	Role                 Role                           `yaml:"role"`
+	Region               string                         `yaml:"region"`
+	TimeoutMinutes       int                            `yaml:"timeoutMinutes"`
+	CheckIntervalSeconds int                            `yaml:"checkIntervalSeconds"`
+	BakeMinutes          int                            `yaml:"bakeMinutes"`
+	LogLines             int                            `yaml:"logLines"`
+	UpdateStrategy       string                         `yaml:"updateStrategy"`
+	OnCancel             string                         `yaml:"onCancel"`
 }
 
 // Role represents an IAM role to assume
 type Role struct {
-	ARN string `yaml:"arn"`
+	ARN         string `yaml:"arn"`
+	ExternalID  string `yaml:"externalId"`
+	SessionName string `yaml:"sessionName"`
 }
 
 // Service represents a service that can be deployed by gehen.
@@ -45,30 +86,105 @@ type Service struct {
 	URL            string
 	UpdateStrategy string
 	Containers     []string
+	// Multiple URLs to check, used instead of URL.
+	URLs []string
+	// How many of the URLs need to show the new version for the deploy check to succeed.
+	// If zero, all of them are required.
+	Quorum int
+	// The AWS region the service is in, derived from the cluster ARN.
+	// If empty, the default region is used.
+	Region string
+	// The IAM role to assume when deploying the service.
+	// If nil, the default credentials are used.
+	Role *Role
+	// The name of the stage the service is deployed in.
+	Stage string
+	// How the deploy check finds the version from the response of URL,
+	// or the non-HTTP check to use if there is no URL.
+	Check Check
+	// How long to wait for the deploy and drain checks before timing out.
+	// If zero, the deploy package default is used.
+	TimeoutDuration time.Duration
+	// How frequently to run the deploy and drain checks.
+	// If zero, the deploy package default is used.
+	CheckIntervalDuration time.Duration
+	// Names of CloudWatch alarms that cause the service to be rolled back
+	// if they go into the ALARM state during the deploy.
+	Alarms []string
+	// How long to keep watching the alarms after the drain check.
+	BakeDuration time.Duration
+	// How many of the last log lines of the containers of failed tasks to show.
+	// If zero, the awsecs package default is used.
+	LogLines int
+	// The CodeDeploy application and deployment group used to deploy the service
+	// if it uses the CODE_DEPLOY deployment controller.
+	CodeDeploy CodeDeploy
+	// The canary of the service. It is deployed in its own stage before the
+	// stage of the service and must succeed for the service to be deployed.
+	Canary *Service
 	// The Git SHA of the previous deployment. Used by Gehen for rollback purposes.
 	// Please do not modify this value.
 	PreviousGitsha            string
 	PreviousTaskDefinitionARN string
 	TaskDefinitionARN         string
 	Tags                      []string
+	// The ID of the CodeDeploy deployment being checked, if the service uses CodeDeploy.
+	DeploymentID string
+}
+
+// CodeDeploy identifies the CodeDeploy deployment group of a service.
+// Empty fields default to the names the ECS console uses for blue/green services.
+type CodeDeploy struct {
+	Application     string
+	DeploymentGroup string
+}
+
+// CheckURLs returns the URLs used to check that the service has deployed.
+func (s *Service) CheckURLs() []string {
+	if len(s.URLs) > 0 {
+		return s.URLs
+	}
+	if s.URL != "" {
+		return []string{s.URL}
+	}
+	return nil
 }
 
 // ScheduledTask represents an ECS Scheduled Task.
 type ScheduledTask struct {
-	Name                      string
-	Gitsha                    string
+	Name   string
+	Gitsha string
+	// The AWS region the scheduled task is in.
+	// If empty, the default region is used.
+	Region                    string
+	Role                      *Role
 	UpdateStrategy            string
 	PreviousGitsha            string
 	TaskDefinitionARN         string
 	PreviousTaskDefinitionARN string
 }
 
+// Stage represents a group of services that are deployed together.
+// Stages are deployed in order, a stage is only deployed once all previous
+// stages have been deployed successfully.
+type Stage struct {
+	Name     string
+	Services []*Service
+	// Whether the stage only contains canaries of the services in the next stage.
+	Canary bool
+}
+
 type ParsedConfig struct {
-	Services       []*Service
-	ScheduledTasks []*ScheduledTask
-	Role           *Role
-	TimeoutMinutes int
-	UpdateStrategy string
+	Services             []*Service
+	ScheduledTasks       []*ScheduledTask
+	Stages               []*Stage
+	Role                 *Role
+	Region               string
+	TimeoutMinutes       int
+	CheckIntervalSeconds int
+	UpdateStrategy       string
+	// What to do if the deploy is cancelled by SIGINT or SIGTERM.
+	OnCancel string
 }
 
 // Read reads the config file at the given path and returns
@@ -90,50 +206,248 @@ func Read(configPath, gitsha string) (ParsedConfig, error) {
 		return ParsedConfig{}, errors.Wrapf(err, "couldn't read yaml file at %s", configPath)
 	}
 
-	updateStrategy := strings.ToLower(config.UpdateStrategy)
-	switch updateStrategy {
-	case UpdateStrategyCurrent, UpdateStrategyLatest, UpdateStrategyRedeploy, UpdateStrategyNone:
-	case "":
-		// Default is current
-		updateStrategy = UpdateStrategyCurrent
-	default:
-		err := errors.Errorf(`config: invalid updateStrategy %q, must be "current", "latest" or "none`, config.UpdateStrategy)
+	updateStrategy, err := parseUpdateStrategy(config.UpdateStrategy)
+	if err != nil {
+		return ParsedConfig{}, err
+	}
+
+	onCancel, err := parseOnCancel(config.OnCancel)
+	if err != nil {
 		return ParsedConfig{}, err
 	}
 
+	var role *Role
+	if config.Role.ARN != "" {
+		role = &config.Role
+	}
+
 	var services []*Service
+	var canaries []*Service
 	for name, s := range config.Services {
-		service := Service{
-			Name:           name,
-			Gitsha:         gitsha,
-			Cluster:        s.Cluster,
-			URL:            s.URL,
-			UpdateStrategy: updateStrategy,
-			Containers:     s.Containers,
+		service, err := parseService(name, s, config, role, updateStrategy, gitsha, filepath.Dir(configPath))
+		if err != nil {
+			return ParsedConfig{}, err
+		}
+		services = append(services, service)
+
+		if s.Canary == nil {
+			continue
+		}
+		canary, err := parseCanary(name, s, config, role, updateStrategy, gitsha, filepath.Dir(configPath))
+		if err != nil {
+			return ParsedConfig{}, err
 		}
-		services = append(services, &service)
+		service.Canary = canary
+		canaries = append(canaries, canary)
+	}
+	if err := checkCanaryNames(services, canaries); err != nil {
+		return ParsedConfig{}, err
 	}
 
+	stages, err := groupStages(config.Stages, services)
+	if err != nil {
+		return ParsedConfig{}, err
+	}
+	stages = addCanaryStages(stages)
+	services = append(services, canaries...)
+
 	var scheduledTasks []*ScheduledTask
-	for name := range config.ScheduledTasks {
+	for name, t := range config.ScheduledTasks {
+		taskRole := role
+		if t.Role != nil && t.Role.ARN != "" {
+			taskRole = t.Role
+		}
+
 		task := ScheduledTask{
 			Name:           name,
 			Gitsha:         gitsha,
+			Region:         t.Region,
+			Role:           taskRole,
 			UpdateStrategy: updateStrategy,
 		}
 		scheduledTasks = append(scheduledTasks, &task)
 	}
 
 	parsedConfig := ParsedConfig{
-		Services:       services,
-		ScheduledTasks: scheduledTasks,
-		TimeoutMinutes: config.TimeoutMinutes,
-		UpdateStrategy: updateStrategy,
+		Services:             services,
+		ScheduledTasks:       scheduledTasks,
+		Stages:               stages,
+		Role:                 role,
+		Region:               config.Region,
+		TimeoutMinutes:       config.TimeoutMinutes,
+		CheckIntervalSeconds: config.CheckIntervalSeconds,
+		UpdateStrategy:       updateStrategy,
+		OnCancel:             onCancel,
 	}
 
-	if config.Role.ARN != "" {
-		parsedConfig.Role = &config.Role
+	return parsedConfig, nil
+}
+
+// parseService validates the config of the named service and returns the service.
+// Settings not set on the service are taken from the top level config.
+func parseService(name string, s serviceConfig, config gehenConfig, role *Role, updateStrategy, gitsha, configDir string) (*Service, error) {
+	var err error
+	// Service level settings take precedence over the top level ones
+	serviceUpdateStrategy := updateStrategy
+	if s.UpdateStrategy != "" {
+		serviceUpdateStrategy, err = parseUpdateStrategy(s.UpdateStrategy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "service %s", name)
+		}
 	}
 
-	return parsedConfig, nil
+	timeoutMinutes := config.TimeoutMinutes
+	if s.TimeoutMinutes != 0 {
+		timeoutMinutes = s.TimeoutMinutes
+	}
+	checkIntervalSeconds := config.CheckIntervalSeconds
+	if s.CheckIntervalSeconds != 0 {
+		checkIntervalSeconds = s.CheckIntervalSeconds
+	}
+
+	bakeMinutes := config.BakeMinutes
+	if s.BakeMinutes != 0 {
+		bakeMinutes = s.BakeMinutes
+	}
+	if bakeMinutes < 0 {
+		return nil, errors.Errorf("config: service %s: invalid bakeMinutes %d, must not be negative", name, bakeMinutes)
+	}
+	// Alarms are watched during the bake period, without one they would only be checked once
+	if len(s.Alarms) > 0 && bakeMinutes == 0 {
+		return nil, errors.Errorf("config: service %s: bakeMinutes must be set to watch alarms", name)
+	}
+
+	logLines := config.LogLines
+	if s.LogLines != 0 {
+		logLines = s.LogLines
+	}
+	if logLines < 0 {
+		return nil, errors.Errorf("config: service %s: invalid logLines %d, must not be negative", name, logLines)
+	}
+
+	serviceRole := role
+	if s.Role != nil && s.Role.ARN != "" {
+		serviceRole = s.Role
+	}
+
+	check, err := parseCheck(s.Check, configDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "service %s", name)
+	}
+
+	if s.URL != "" && len(s.URLs) > 0 {
+		return nil, errors.Errorf("config: service %s: url and urls cannot both be set", name)
+	}
+	numURLs := len(s.URLs)
+	if s.URL != "" {
+		numURLs = 1
+	}
+	if probes := s.Check.probes(); numURLs > 0 && len(probes) > 0 {
+		return nil, errors.Errorf("config: service %s: check.%s cannot be set with a url", name, probes[0])
+	}
+	quorum, err := parseQuorum(s.Quorum, numURLs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "service %s", name)
+	}
+
+	service := Service{
+		Name:                  name,
+		Gitsha:                gitsha,
+		Cluster:               s.Cluster,
+		Region:                clusterRegion(s.Cluster),
+		Role:                  serviceRole,
+		URL:                   s.URL,
+		URLs:                  s.URLs,
+		Quorum:                quorum,
+		UpdateStrategy:        serviceUpdateStrategy,
+		Containers:            s.Containers,
+		TimeoutDuration:       time.Duration(timeoutMinutes) * time.Minute,
+		CheckIntervalDuration: time.Duration(checkIntervalSeconds) * time.Second,
+		Stage:                 s.Stage,
+		Check:                 check,
+		Alarms:                s.Alarms,
+		BakeDuration:          time.Duration(bakeMinutes) * time.Minute,
+		LogLines:              logLines,
+		CodeDeploy: CodeDeploy{
+			Application:     s.CodeDeploy.Application,
+			DeploymentGroup: s.CodeDeploy.DeploymentGroup,
+		},
+	}
+	return &service, nil
+}
+
+// parseUpdateStrategy validates the given update strategy and normalizes it.
+// An empty strategy defaults to UpdateStrategyCurrent.
+func parseUpdateStrategy(updateStrategy string) (string, error) {
+	s := strings.ToLower(updateStrategy)
+	switch s {
+	case UpdateStrategyCurrent, UpdateStrategyLatest, UpdateStrategyRedeploy, UpdateStrategyNone:
+		return s, nil
+	case "":
+		// Default is current
+		return UpdateStrategyCurrent, nil
+	}
+	return "", errors.Errorf(`config: invalid updateStrategy %q, must be "current", "latest", "redeploy" or "none"`, updateStrategy)
+}
+
+// parseOnCancel validates the given cancel behaviour and normalizes it.
+// An empty value defaults to OnCancelRollback.
+func parseOnCancel(onCancel string) (string, error) {
+	s := strings.ToLower(onCancel)
+	switch s {
+	case OnCancelRollback, OnCancelLeave, OnCancelWait:
+		return s, nil
+	case "":
+		// Default is rollback so services aren't left with a partial deploy
+		return OnCancelRollback, nil
+	}
+	return "", errors.Errorf(`config: invalid onCancel %q, must be "rollback", "leave" or "wait"`, onCancel)
+}
+
+// clusterRegion returns the region of the given cluster ARN.
+// If the cluster is not a valid ARN an empty string is returned.
+func clusterRegion(cluster string) string {
+	clusterARN, err := arn.Parse(cluster)
+	if err != nil {
+		return ""
+	}
+	return clusterARN.Region
+}
+
+// groupStages groups the services into the given stages, preserving the order of the stages.
+// If no stages are given, all services are placed in a single unnamed stage.
+func groupStages(stageNames []string, services []*Service) ([]*Stage, error) {
+	if len(stageNames) == 0 {
+		for _, s := range services {
+			if s.Stage != "" {
+				return nil, errors.Errorf("config: service %s has stage %q but no stages are defined", s.Name, s.Stage)
+			}
+		}
+		if len(services) == 0 {
+			return nil, nil
+		}
+		return []*Stage{{Services: services}}, nil
+	}
+
+	stages := make([]*Stage, len(stageNames))
+	stageMap := make(map[string]*Stage)
+	for i, name := range stageNames {
+		if _, ok := stageMap[name]; ok {
+			return nil, errors.Errorf("config: stage %q is defined more than once", name)
+		}
+		stages[i] = &Stage{Name: name}
+		stageMap[name] = stages[i]
+	}
+
+	for _, s := range services {
+		if s.Stage == "" {
+			return nil, errors.Errorf("config: service %s must have a stage since stages are defined", s.Name)
+		}
+		stage, ok := stageMap[s.Stage]
+		if !ok {
+			return nil, errors.Errorf("config: service %s has unknown stage %q", s.Name, s.Stage)
+		}
+		stage.Services = append(stage.Services, s)
+	}
+	return stages, nil
 }
@@ -1,7 +1,9 @@
 package config_test
 
 import (
+	"os"
 	"testing"
+	"time"
 
 	"github.com/TouchBistro/gehen/config"
 	"github.com/stretchr/testify/assert"
@@ -9,40 +11,47 @@ import (
 
 func TestReadServicesWithRole(t *testing.T) {
 	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	expectedRole := &config.Role{
+		ARN: "arn:aws:iam::123456:role/OrganizationAccountAccessRole",
+	}
 	expectedServices := []*config.Service{
 		{
-			Name:           "example-production",
-			Gitsha:         gitsha,
-			Cluster:        "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
-			URL:            "https://example.touchbistro.io/ping",
-			UpdateStrategy: config.UpdateStrategyLatest,
-			Containers:     []string{"sidecar", "service"},
+			Name:            "example-production",
+			Gitsha:          gitsha,
+			Cluster:         "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+			Region:          "us-east-1",
+			Role:            expectedRole,
+			URL:             "https://example.touchbistro.io/ping",
+			UpdateStrategy:  config.UpdateStrategyLatest,
+			Containers:      []string{"sidecar", "service"},
+			TimeoutDuration: 5 * time.Minute,
 		},
 		{
-			Name:           "example-staging",
-			Gitsha:         gitsha,
-			Cluster:        "arn:aws:ecs:us-east-1:123456:cluster/non-prod-cluster",
-			URL:            "https://staging.example.touchbistro.io/ping",
-			UpdateStrategy: config.UpdateStrategyLatest,
+			Name:            "example-staging",
+			Gitsha:          gitsha,
+			Cluster:         "arn:aws:ecs:us-east-1:123456:cluster/non-prod-cluster",
+			Region:          "us-east-1",
+			Role:            expectedRole,
+			URL:             "https://staging.example.touchbistro.io/ping",
+			UpdateStrategy:  config.UpdateStrategyLatest,
+			TimeoutDuration: 5 * time.Minute,
 		},
 	}
 	expectedScheduledTasks := []*config.ScheduledTask{
 		{
 			Name:           "weekly-job",
 			Gitsha:         gitsha,
+			Role:           expectedRole,
 			UpdateStrategy: config.UpdateStrategyLatest,
 		},
 		{
 			Name:           "monthly-job",
 			Gitsha:         gitsha,
+			Role:           expectedRole,
 			UpdateStrategy: config.UpdateStrategyLatest,
 		},
 	}
 
-	expectedRole := &config.Role{
-		ARN: "arn:aws:iam::123456:role/OrganizationAccountAccessRole",
-	}
-
 	parsedConfig, err := config.Read("testdata/gehen.good.yml", gitsha)
 
 	assert.NoError(t, err)
@@ -59,6 +68,7 @@ func TestReadServicesWithoutRole(t *testing.T) {
 			Name:           "example-production",
 			Gitsha:         gitsha,
 			Cluster:        "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+			Region:         "us-east-1",
 			URL:            "https://example.touchbistro.io/ping",
 			UpdateStrategy: config.UpdateStrategyCurrent,
 		},
@@ -66,6 +76,7 @@ func TestReadServicesWithoutRole(t *testing.T) {
 			Name:           "example-staging",
 			Gitsha:         gitsha,
 			Cluster:        "arn:aws:ecs:us-east-1:123456:cluster/non-prod-cluster",
+			Region:         "us-east-1",
 			URL:            "https://staging.example.touchbistro.io/ping",
 			UpdateStrategy: config.UpdateStrategyCurrent,
 		},
@@ -92,6 +103,364 @@ func TestReadServicesWithoutRole(t *testing.T) {
 	assert.Equal(t, 0, parsedConfig.TimeoutMinutes)
 }
 
+func TestReadServicesWithOverrides(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	expectedServices := []*config.Service{
+		{
+			Name:                  "example-production",
+			Gitsha:                gitsha,
+			Cluster:               "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+			Region:                "us-east-1",
+			URL:                   "https://example.touchbistro.io/ping",
+			UpdateStrategy:        config.UpdateStrategyLatest,
+			TimeoutDuration:       15 * time.Minute,
+			CheckIntervalDuration: 30 * time.Second,
+			Alarms:                []string{"example-production-5xx", "example-production-p99-latency"},
+			BakeDuration:          10 * time.Minute,
+			LogLines:              50,
+		},
+		{
+			Name:                  "example-worker",
+			Gitsha:                gitsha,
+			Cluster:               "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+			Region:                "us-east-1",
+			UpdateStrategy:        config.UpdateStrategyCurrent,
+			TimeoutDuration:       5 * time.Minute,
+			CheckIntervalDuration: 5 * time.Second,
+			BakeDuration:          2 * time.Minute,
+			LogLines:              30,
+		},
+	}
+
+	parsedConfig, err := config.Read("testdata/gehen.overrides.yml", gitsha)
+
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, expectedServices, parsedConfig.Services)
+	assert.Equal(t, config.UpdateStrategyCurrent, parsedConfig.UpdateStrategy)
+	assert.Equal(t, 5, parsedConfig.TimeoutMinutes)
+	assert.Equal(t, 30, parsedConfig.CheckIntervalSeconds)
+	assert.Equal(t, config.OnCancelWait, parsedConfig.OnCancel)
+}
+
+func TestReadServicesRegions(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	expectedServices := []*config.Service{
+		{
+			Name:           "example-canada",
+			Gitsha:         gitsha,
+			Cluster:        "arn:aws:ecs:ca-central-1:123456:cluster/prod-cluster",
+			Region:         "ca-central-1",
+			UpdateStrategy: config.UpdateStrategyCurrent,
+		},
+		{
+			Name:           "example-europe",
+			Gitsha:         gitsha,
+			Cluster:        "arn:aws:ecs:eu-west-1:123456:cluster/prod-cluster",
+			Region:         "eu-west-1",
+			UpdateStrategy: config.UpdateStrategyCurrent,
+		},
+	}
+
+	parsedConfig, err := config.Read("testdata/gehen.regions.yml", gitsha)
+
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, expectedServices, parsedConfig.Services)
+	assert.Equal(t, "us-west-2", parsedConfig.Region)
+
+	regions := make(map[string]string)
+	for _, task := range parsedConfig.ScheduledTasks {
+		regions[task.Name] = task.Region
+	}
+	// weekly-job has no region so the default region is used
+	assert.Equal(t, map[string]string{"weekly-job": "", "monthly-job": "eu-west-1"}, regions)
+}
+
+func TestReadServicesPerServiceRole(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	defaultRole := &config.Role{
+		ARN: "arn:aws:iam::123456:role/OrganizationAccountAccessRole",
+	}
+	productionRole := &config.Role{
+		ARN:         "arn:aws:iam::654321:role/GehenDeploy",
+		ExternalID:  "gehen",
+		SessionName: "gehen-production",
+	}
+	expectedServices := []*config.Service{
+		{
+			Name:           "example-production",
+			Gitsha:         gitsha,
+			Cluster:        "arn:aws:ecs:us-east-1:654321:cluster/prod-cluster",
+			Region:         "us-east-1",
+			Role:           productionRole,
+			UpdateStrategy: config.UpdateStrategyCurrent,
+		},
+		{
+			Name:           "example-staging",
+			Gitsha:         gitsha,
+			Cluster:        "arn:aws:ecs:us-east-1:123456:cluster/non-prod-cluster",
+			Region:         "us-east-1",
+			Role:           defaultRole,
+			UpdateStrategy: config.UpdateStrategyCurrent,
+		},
+	}
+	expectedScheduledTasks := []*config.ScheduledTask{
+		{
+			Name:           "weekly-job",
+			Gitsha:         gitsha,
+			Role:           productionRole,
+			UpdateStrategy: config.UpdateStrategyCurrent,
+		},
+		{
+			Name:           "monthly-job",
+			Gitsha:         gitsha,
+			Role:           defaultRole,
+			UpdateStrategy: config.UpdateStrategyCurrent,
+		},
+	}
+
+	parsedConfig, err := config.Read("testdata/gehen.roles.yml", gitsha)
+
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, expectedServices, parsedConfig.Services)
+	assert.ElementsMatch(t, expectedScheduledTasks, parsedConfig.ScheduledTasks)
+	assert.Equal(t, defaultRole, parsedConfig.Role)
+}
+
+func TestReadServicesStages(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	expectedStages := []*config.Stage{
+		{
+			Name: "staging",
+			Services: []*config.Service{
+				{
+					Name:           "example-staging",
+					Gitsha:         gitsha,
+					Cluster:        "arn:aws:ecs:us-east-1:123456:cluster/non-prod-cluster",
+					Region:         "us-east-1",
+					UpdateStrategy: config.UpdateStrategyCurrent,
+					Stage:          "staging",
+				},
+			},
+		},
+		{
+			Name: "production",
+			Services: []*config.Service{
+				{
+					Name:           "example-production",
+					Gitsha:         gitsha,
+					Cluster:        "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+					Region:         "us-east-1",
+					UpdateStrategy: config.UpdateStrategyCurrent,
+					Stage:          "production",
+				},
+			},
+		},
+	}
+
+	parsedConfig, err := config.Read("testdata/gehen.stages.yml", gitsha)
+
+	assert.NoError(t, err)
+	assert.Equal(t, expectedStages, parsedConfig.Stages)
+	assert.Len(t, parsedConfig.Services, 2)
+}
+
+func TestReadServicesNoStages(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	parsedConfig, err := config.Read("testdata/gehen.no-role.yml", gitsha)
+
+	assert.NoError(t, err)
+	assert.Len(t, parsedConfig.Stages, 1)
+	assert.Equal(t, "", parsedConfig.Stages[0].Name)
+	assert.ElementsMatch(t, parsedConfig.Services, parsedConfig.Stages[0].Services)
+	assert.Equal(t, config.OnCancelRollback, parsedConfig.OnCancel)
+}
+
+func TestReadServicesUnknownStage(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	parsedConfig, err := config.Read("testdata/gehen.bad-stage.yml", gitsha)
+
+	assert.Error(t, err)
+	assert.Nil(t, parsedConfig.Services)
+	assert.Nil(t, parsedConfig.Stages)
+}
+
+func TestReadServicesCanary(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	expectedCanary := &config.Service{
+		Name:            "example-production-canary",
+		Gitsha:          gitsha,
+		Cluster:         "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+		Region:          "us-east-1",
+		URL:             "https://canary.example.touchbistro.io/ping",
+		UpdateStrategy:  config.UpdateStrategyCurrent,
+		Stage:           "production",
+		TimeoutDuration: 15 * time.Minute,
+		Alarms:          []string{"example-production-canary-5xx"},
+		BakeDuration:    10 * time.Minute,
+	}
+
+	parsedConfig, err := config.Read("testdata/gehen.canary.yml", gitsha)
+
+	assert.NoError(t, err)
+	assert.Len(t, parsedConfig.Services, 3)
+	assert.Len(t, parsedConfig.Stages, 3)
+
+	stageNames := make([]string, len(parsedConfig.Stages))
+	for i, stage := range parsedConfig.Stages {
+		stageNames[i] = stage.Name
+	}
+	assert.Equal(t, []string{"staging", "production-canary", "production"}, stageNames)
+
+	canaryStage := parsedConfig.Stages[1]
+	assert.True(t, canaryStage.Canary)
+	assert.Equal(t, []*config.Service{expectedCanary}, canaryStage.Services)
+	assert.Equal(t, expectedCanary, parsedConfig.Stages[2].Services[0].Canary)
+	assert.Equal(t, "https://example.touchbistro.io/ping", parsedConfig.Stages[2].Services[0].URL)
+}
+
+func TestReadServicesCanaryDuplicateName(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	parsedConfig, err := config.Read("testdata/gehen.bad-canary.yml", gitsha)
+
+	assert.Error(t, err)
+	assert.Nil(t, parsedConfig.Services)
+	assert.Nil(t, parsedConfig.Stages)
+}
+
+func TestReadServicesCheck(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	parsedConfig, err := config.Read("testdata/gehen.check.yml", gitsha)
+
+	assert.NoError(t, err)
+	assert.Len(t, parsedConfig.Services, 2)
+	for _, s := range parsedConfig.Services {
+		switch s.Name {
+		case "example-production":
+			assert.Equal(t, "/version/commit", s.Check.JSONPointer)
+			assert.Equal(t, 5, s.Check.SuccessThreshold)
+			assert.Equal(t, 10, s.Check.NoOldVersionInLast)
+			assert.Empty(t, s.Check.Header)
+			assert.Nil(t, s.Check.Regex)
+		case "example-staging":
+			assert.Equal(t, "X-App-Revision", s.Check.Header)
+			assert.Equal(t, `^example-(\w+)$`, s.Check.Regex.String())
+		}
+	}
+}
+
+func TestReadServicesCheckRequest(t *testing.T) {
+	os.Setenv("GEHEN_TEST_TOKEN", "secret")
+	defer os.Unsetenv("GEHEN_TEST_TOKEN")
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	parsedConfig, err := config.Read("testdata/gehen.check-request.yml", gitsha)
+
+	assert.NoError(t, err)
+	assert.Len(t, parsedConfig.Services, 1)
+	check := parsedConfig.Services[0].Check
+	assert.Equal(t, "HEAD", check.Method)
+	assert.Equal(t, map[string]string{
+		"Authorization": "Bearer secret",
+		"Host":          "example.touchbistro.io",
+	}, check.Headers)
+	assert.Equal(t, 5*time.Second, check.Timeout)
+	// Relative to the directory of the config file
+	assert.Equal(t, "testdata/ca.pem", check.CABundle)
+}
+
+func TestReadServicesCheckHeadWithoutHeader(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	parsedConfig, err := config.Read("testdata/gehen.bad-check-method.yml", gitsha)
+
+	assert.Error(t, err)
+	assert.Nil(t, parsedConfig.Services)
+}
+
+func TestReadServicesCheckRequestMissingEnv(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	parsedConfig, err := config.Read("testdata/gehen.check-request.yml", gitsha)
+
+	assert.Error(t, err)
+	assert.Nil(t, parsedConfig.Services)
+}
+
+func TestReadServicesInvalidCheck(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	parsedConfig, err := config.Read("testdata/gehen.bad-check.yml", gitsha)
+
+	assert.Error(t, err)
+	assert.Nil(t, parsedConfig.Services)
+}
+
+func TestReadServicesURLs(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	parsedConfig, err := config.Read("testdata/gehen.urls.yml", gitsha)
+
+	assert.NoError(t, err)
+	assert.Len(t, parsedConfig.Services, 3)
+	for _, s := range parsedConfig.Services {
+		switch s.Name {
+		case "example-production":
+			assert.Len(t, s.CheckURLs(), 3)
+			assert.Equal(t, 2, s.Quorum)
+		case "example-staging":
+			assert.Len(t, s.CheckURLs(), 2)
+			assert.Equal(t, 1, s.Quorum)
+		case "example-worker":
+			assert.Equal(t, []string{"https://worker.example.touchbistro.io/ping"}, s.CheckURLs())
+			assert.Equal(t, 0, s.Quorum)
+		}
+	}
+}
+
+func TestReadServicesInvalidQuorum(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	parsedConfig, err := config.Read("testdata/gehen.bad-quorum.yml", gitsha)
+
+	assert.Error(t, err)
+	assert.Nil(t, parsedConfig.Services)
+}
+
+func TestReadServicesAlarmsWithoutBake(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	parsedConfig, err := config.Read("testdata/gehen.bad-alarms.yml", gitsha)
+
+	assert.Error(t, err)
+	assert.Nil(t, parsedConfig.Services)
+}
+
+func TestReadServicesProbes(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	parsedConfig, err := config.Read("testdata/gehen.probes.yml", gitsha)
+
+	assert.NoError(t, err)
+	assert.Len(t, parsedConfig.Services, 3)
+	for _, s := range parsedConfig.Services {
+		assert.Empty(t, s.CheckURLs())
+		switch s.Name {
+		case "example-grpc":
+			assert.Equal(t, &config.GRPCCheck{
+				Address:         "grpc.example.touchbistro.io:443",
+				Service:         "example.v1.Example",
+				VersionMetadata: "x-version",
+				TLS:             true,
+			}, s.Check.GRPC)
+		case "example-worker":
+			assert.Equal(t, []string{"./scripts/worker-version.sh", "--env", "prod"}, s.Check.Command)
+		case "example-socket":
+			assert.Equal(t, "socket.example.touchbistro.io:9000", s.Check.TCP)
+		}
+	}
+}
+
+func TestReadServicesProbeWithURL(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	parsedConfig, err := config.Read("testdata/gehen.bad-probe.yml", gitsha)
+
+	assert.Error(t, err)
+	assert.Nil(t, parsedConfig.Services)
+}
+
 func TestReadServicesInvalid(t *testing.T) {
 	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
 	parsedConfig, err := config.Read("testdata/gehen.bad.yml", gitsha)
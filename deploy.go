@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/TouchBistro/gehen/awsecs"
+	"github.com/TouchBistro/gehen/config"
+	"github.com/TouchBistro/gehen/deploy"
+	"github.com/TouchBistro/goutils/color"
+	"github.com/TouchBistro/goutils/fatal"
+	"github.com/getsentry/sentry-go"
+	"github.com/pkg/errors"
+)
+
+func runDeploy(args []string) {
+	fs, cf := newFlagSet("deploy")
+	var (
+		versionFlag bool
+		gitsha      string
+		dryRun      bool
+	)
+	fs.BoolVar(&versionFlag, "version", false, "Prints the current gehen version")
+	fs.StringVar(&gitsha, "gitsha", "", "The gitsha of the version to be deployed")
+	fs.BoolVar(&dryRun, "dry-run", false, "Prints the changes that would be made without deploying anything (same as gehen plan)")
+	parseFlags(fs, args)
+
+	if versionFlag {
+		if version == "" {
+			version = "source"
+		}
+
+		fmt.Printf("gehen version %s\n", version)
+		os.Exit(0)
+	}
+
+	// gitsha is required
+	if gitsha == "" {
+		fatal.Exit("Must provide a gitsha")
+	}
+
+	if dryRun {
+		plan(cf, gitsha)
+		return
+	}
+
+	initObservability()
+	defer cleanup()
+
+	// gehen config, get and validate services
+	parsedConfig := readConfig(cf.configPath, gitsha)
+	ctx, stopSignals := signalContext()
+	defer stopSignals()
+	clients := newClients(ctx, parsedConfig, cf)
+
+	// ctx is cancelled as soon as a signal is received, which stops the current phase.
+	// To let the current phase finish it is run with a context that is never cancelled,
+	// DeployStages will still stop before starting the next phase.
+	phaseCtx := ctx
+	if parsedConfig.OnCancel == config.OnCancelWait {
+		phaseCtx = context.Background()
+	}
+
+	if parsedConfig.TimeoutMinutes != 0 {
+		deploy.TimeoutDuration(time.Duration(parsedConfig.TimeoutMinutes) * time.Minute)
+	}
+
+	// DEPLOYMENT ZONE //
+
+	// Update scheduled tasks first so if this fails we don't need to worry about rolling back services
+	updateScheduledTaskResults := deploy.UpdateScheduledTasks(phaseCtx, parsedConfig.ScheduledTasks, clients, clients)
+	updateScheduledTasksFailed := false
+
+	for _, result := range updateScheduledTaskResults {
+		if result.Err == nil {
+			continue
+		}
+
+		updateScheduledTasksFailed = true
+		log.Printf(
+			"Failed to update scheduled task %s to version %s",
+			color.Cyan(result.Task.Name),
+			color.Magenta(result.Task.Gitsha),
+		)
+		log.Printf("Error: %v", result.Err)
+
+		if useSentry {
+			sentry.CaptureException(result.Err)
+		}
+	}
+
+	if updateScheduledTasksFailed {
+		fatal.Exit(color.Red("Failed to update some scheduled tasks"))
+	}
+
+	stageResults := deploy.DeployStages(phaseCtx, ctx, parsedConfig.Stages, clients)
+	for _, result := range stageResults {
+		reportStage(result)
+	}
+
+	// Only services that had new deployments created need to be rolled back.
+	// This covers all stages that were touched, any stages after a failed one were never deployed.
+	deployedServices := deploy.DeployedServices(stageResults)
+	var lastResult deploy.StageResult
+	if len(stageResults) > 0 {
+		lastResult = stageResults[len(stageResults)-1]
+	}
+	stageErr := lastResult.Err
+	if stageErr != nil && lastResult.Stage.Canary {
+		log.Println(color.Yellow("The canary deploy failed so the services it is a canary for were not deployed"))
+	}
+
+	// If a signal was received while a phase that then failed was finishing, ctx is
+	// already cancelled and can't be used to roll back.
+	rollbackCtx := ctx
+	if ctx.Err() != nil {
+		rollbackCtx = context.Background()
+	}
+
+	switch {
+	case stageErr == nil:
+	case errors.Is(stageErr, deploy.ErrDeployFailed):
+		// If deploying failed we need to rollback all services that succeeded so that they aren't in inconsitent states
+		// If deploy failed that means the new version wasn't even registered on ECS so we only need to rollback ones that succeeded
+		log.Println(color.Red("Failed to create new versions of some services"))
+		log.Println(color.Yellow("Rolling back services that succeeded to prevent inconsistent states"))
+		performRollback(rollbackCtx, deployedServices, parsedConfig.ScheduledTasks, clients)
+	case errors.Is(stageErr, deploy.ErrCheckDeployedFailed):
+		// If check deployment failed we need to roll everything back
+		// Services that timed out are likely stuck in a death loop
+		log.Println(color.Red("Some services failed deployment"))
+		log.Println("This means your service failed to boot, or was unable to serve requests.")
+		log.Println("Your next step should be to check the logs for your service to find out why.")
+		diagnose(rollbackCtx, deploy.FailedServices(lastResult), clients)
+
+		if len(deployedServices) == 0 {
+			fatal.Exit("❌ Deployment failed")
+		}
+
+		log.Println(color.Yellow("Rolling all services back to the previous version"))
+		performRollback(rollbackCtx, deployedServices, parsedConfig.ScheduledTasks, clients)
+	case errors.Is(stageErr, deploy.ErrCheckDrainedFailed):
+		log.Println(color.Red("Some services failed to drain old versions"))
+		log.Println("This means the new version failed to boot, or was unable to serve requests.")
+		log.Println("Your next step should be to check the logs for your service to find out why.")
+		diagnose(rollbackCtx, deploy.FailedServices(lastResult), clients)
+
+		if len(deployedServices) == 0 {
+			fatal.Exit("❌ Deployment failed")
+		}
+
+		log.Println(color.Yellow("Rolling all services back to the previous version"))
+		performRollback(rollbackCtx, deployedServices, parsedConfig.ScheduledTasks, clients)
+	case errors.Is(stageErr, deploy.ErrBakeFailed):
+		log.Println(color.Red("Some services degraded or triggered alarms after deploying"))
+		log.Println("This means the new version is causing errors or is performing worse than the previous one.")
+		diagnose(rollbackCtx, deploy.FailedServices(lastResult), clients)
+
+		if len(deployedServices) == 0 {
+			fatal.Exit("❌ Deployment failed")
+		}
+
+		log.Println(color.Yellow("Rolling all services back to the previous version"))
+		performRollback(rollbackCtx, deployedServices, parsedConfig.ScheduledTasks, clients)
+	case errors.Is(stageErr, deploy.ErrCancelled):
+		log.Println(color.Red("Deployment was cancelled"))
+		sendStatsdEvents(deployedServices, "gehen.deploys.cancelled", "Gehen deploy of %s was cancelled")
+
+		if parsedConfig.OnCancel == config.OnCancelRollback {
+			log.Println(color.Yellow("Rolling all services back to the previous version"))
+			performRollback(rollbackCtx, deployedServices, parsedConfig.ScheduledTasks, clients)
+		}
+
+		for _, s := range deployedServices {
+			log.Printf(
+				"%s was left deploying version %s using %s",
+				color.Cyan(s.Name),
+				color.Magenta(s.Gitsha),
+				s.TaskDefinitionARN,
+			)
+		}
+		fatal.Exit("❌ Deployment cancelled")
+	case errors.Is(stageErr, deploy.ErrTimedOut):
+		log.Println(color.Yellow("Some services still have the old version running"))
+		log.Println(color.Yellow("This means there are two different versions of the same service in production"))
+		log.Println(color.Yellow("Please investigate why this is the case"))
+		// Do any cleanup manually since we are calling Exit and therefore defer won't run
+		cleanup()
+		// Exit code 2 to signal that this wasn't a successful deploy but it also wasn't a certain failure
+		os.Exit(2)
+	}
+
+	log.Println(color.Green("🚀 Finished deploying all services 🚀"))
+}
+
+// reportStage logs the results of each step of the stage and sends the corresponding statsd events.
+func reportStage(result deploy.StageResult) {
+	for _, r := range result.DeployResults {
+		if r.Err == nil {
+			continue
+		}
+
+		log.Printf(
+			"Failed to create new deployment to version %s for %s",
+			color.Magenta(r.Service.Gitsha),
+			color.Cyan(r.Service.Name),
+		)
+		log.Printf("Error: %v", r.Err)
+
+		if useSentry {
+			sentry.CaptureException(r.Err)
+		}
+	}
+
+	if result.CheckDeployedResults == nil {
+		return
+	}
+	sendStatsdEvents(result.Deployed, "gehen.deploys.started", "Gehen started a deploy for service %s")
+
+	for _, r := range result.CheckDeployedResults {
+		if r.Err == nil || r.Err == deploy.ErrCancelled {
+			continue
+		}
+
+		if errors.Is(r.Err, deploy.ErrTimedOut) {
+			log.Printf(
+				"Timed out while checking for deployed version %s of %s",
+				color.Magenta(r.Service.Gitsha),
+				color.Cyan(r.Service.Name),
+			)
+			continue
+		}
+
+		log.Printf(
+			"Failed to check for deployed version %s of %s",
+			color.Magenta(r.Service.Gitsha),
+			color.Cyan(r.Service.Name),
+		)
+		log.Printf("Error: %v", r.Err)
+
+		if useSentry {
+			sentry.CaptureException(r.Err)
+		}
+	}
+
+	if result.CheckDrainedResults == nil {
+		return
+	}
+	sendStatsdEvents(result.Stage.Services, "gehen.deploys.draining", "Gehen is checking for service drain on %s")
+
+	for _, r := range result.CheckDrainedResults {
+		if r.Err == nil || r.Err == deploy.ErrCancelled {
+			continue
+		}
+
+		if errors.Is(r.Err, deploy.ErrTimedOut) {
+			log.Printf("Timed out while waiting for old versions of %s to stop running", color.Cyan(r.Service.Name))
+			continue
+		}
+
+		if errors.Is(r.Err, awsecs.ErrHealthcheckFailed) {
+			log.Printf("Container health checks failed for %s", color.Cyan(r.Service.Name))
+		}
+		if errors.Is(r.Err, awsecs.ErrDeploymentFailed) {
+			log.Printf("The ECS deployment circuit breaker failed the deployment of %s", color.Cyan(r.Service.Name))
+		}
+		if errors.Is(r.Err, awsecs.ErrCodeDeployFailed) {
+			log.Printf("CodeDeploy deployment failed for %s", color.Cyan(r.Service.Name))
+		}
+
+		log.Printf("Failed to check if old version of %s are gone", color.Cyan(r.Service.Name))
+		log.Printf("Error: %v", r.Err)
+
+		if useSentry {
+			sentry.CaptureException(r.Err)
+		}
+	}
+
+	for _, r := range result.BakeResults {
+		if r.Err == nil || r.Err == deploy.ErrCancelled {
+			continue
+		}
+
+		switch {
+		case errors.Is(r.Err, awsecs.ErrAlarm):
+			log.Printf("Alarm triggered for %s", color.Cyan(r.Service.Name))
+		case errors.Is(r.Err, awsecs.ErrHealthcheckFailed):
+			log.Printf("Container health checks failed for %s", color.Cyan(r.Service.Name))
+		case errors.Is(r.Err, deploy.ErrDegraded):
+			log.Printf("Deploy check started failing for %s", color.Cyan(r.Service.Name))
+		default:
+			log.Printf("Failed to bake %s", color.Cyan(r.Service.Name))
+		}
+		log.Printf("Error: %v", r.Err)
+
+		if useSentry {
+			sentry.CaptureException(r.Err)
+		}
+	}
+
+	if result.Err == nil {
+		sendStatsdEvents(result.Stage.Services, "gehen.deploys.completed", "Gehen successfully deployed %s")
+	}
+}
+
+// diagnose logs why the services may have failed using the stopped tasks of the new version
+// and the latest events of each service in ECS.
+func diagnose(ctx context.Context, services []*config.Service, clients *awsecs.Clients) {
+	if len(services) == 0 {
+		return
+	}
+
+	log.Println(color.Yellow("Failure diagnosis:"))
+	for _, r := range deploy.Diagnose(ctx, services, clients, clients) {
+		if r.Err != nil {
+			log.Printf("Failed to diagnose %s", color.Cyan(r.Service.Name))
+			log.Printf("Error: %v", r.Err)
+			continue
+		}
+
+		if len(r.Diagnosis.StoppedTasks) == 0 {
+			log.Printf("No stopped tasks of the new version of %s", color.Cyan(r.Service.Name))
+		}
+		for _, task := range r.Diagnosis.StoppedTasks {
+			log.Printf("Task %s of %s stopped: %s", task.ID, color.Cyan(r.Service.Name), color.Red(task.StoppedReason))
+			for _, c := range task.Containers {
+				if c.ExitCode == nil {
+					if c.Reason != "" {
+						log.Printf("  Container %s did not start: %s", c.Name, c.Reason)
+					}
+					continue
+				}
+				log.Printf("  Container %s exited with code %d: %s", c.Name, *c.ExitCode, c.Reason)
+			}
+		}
+
+		for _, id := range r.Diagnosis.UnhealthyTasks {
+			log.Printf("Task %s of %s is unhealthy", id, color.Cyan(r.Service.Name))
+		}
+
+		if len(r.Diagnosis.Events) > 0 {
+			log.Printf("Latest events of %s:", color.Cyan(r.Service.Name))
+		}
+		for _, e := range r.Diagnosis.Events {
+			log.Printf("  %s %s", e.CreatedAt.Format(time.RFC3339), e.Message)
+		}
+
+		for _, l := range r.Diagnosis.Logs {
+			if l.Err != nil {
+				log.Printf("Failed to get logs of container %s of task %s: %v", l.Container, l.TaskID, l.Err)
+				continue
+			}
+			log.Printf("Last %d log lines of container %s of task %s (%s):", len(l.Lines), l.Container, l.TaskID, color.Blue(l.Region+":"+l.LogGroup+"/"+l.LogStream))
+			for _, line := range l.Lines {
+				log.Printf("  %s", line)
+			}
+		}
+	}
+}
+
+// rollback rolls back the services and scheduled tasks to their previous versions and waits
+// for the rollback to complete. It exits if the rollback fails.
+func rollback(ctx context.Context, services []*config.Service, scheduledTasks []*config.ScheduledTask, clients *awsecs.Clients) {
+	rollbackResults := deploy.Rollback(ctx, services, clients, clients)
+	exitIfRollbackCancelled(ctx)
+	rollbackFailed := false
+
+	for _, result := range rollbackResults {
+		if result.Err == nil {
+			continue
+		}
+
+		rollbackFailed = true
+		log.Printf("Failed to create rollback to %s for %s", color.Magenta(result.Service.Gitsha), color.Cyan(result.Service.Name))
+		log.Printf("Error: %v", result.Err)
+
+		if useSentry {
+			sentry.CaptureException(result.Err)
+		}
+	}
+
+	if rollbackFailed {
+		fatal.Exit(color.Red("🚨 Failed to create rollbacks for services 🚨"))
+	}
+
+	sendStatsdEvents(services, "gehen.rollbacks.started", "Gehen started a rollback for service %s")
+
+	checkDeployedResults := deploy.CheckDeployed(ctx, services, clients)
+	exitIfRollbackCancelled(ctx)
+	checkDeployedFailed := false
+
+	for _, result := range checkDeployedResults {
+		if result.Err == nil {
+			continue
+		}
+
+		checkDeployedFailed = true
+
+		if errors.Is(result.Err, deploy.ErrTimedOut) {
+			log.Printf(
+				"Timed out while checking for rolled back version %s of %s",
+				color.Magenta(result.Service.Gitsha),
+				color.Cyan(result.Service.Name),
+			)
+			continue
+		}
+
+		log.Printf(
+			"Failed to check for rolled back version %s of %s",
+			color.Magenta(result.Service.Gitsha),
+			color.Cyan(result.Service.Name),
+		)
+		log.Printf("Error: %v", result.Err)
+
+		if useSentry {
+			sentry.CaptureException(result.Err)
+		}
+	}
+
+	if checkDeployedFailed {
+		log.Println("This means your service failed to boot, or was unable to serve requests.")
+		log.Println("Your next step should be to check the logs for your service to find out why.")
+		fatal.Exit(color.Red("🚨 Failed to confirm services rolled back 🚨"))
+	}
+
+	sendStatsdEvents(services, "gehen.rollbacks.draining", "Gehen is checking for service rollback drain on %s")
+
+	checkDrainedResults := deploy.CheckDrained(ctx, services, clients, clients, clients)
+	exitIfRollbackCancelled(ctx)
+	checkDrainedFailed := false
+
+	for _, result := range checkDrainedResults {
+		if result.Err == nil {
+			continue
+		}
+
+		checkDrainedFailed = true
+
+		if errors.Is(result.Err, deploy.ErrTimedOut) {
+			log.Printf("Timed out while waiting for new versions of %s to stop running", color.Cyan(result.Service.Name))
+			continue
+		}
+
+		log.Printf("Failed to check if new deployments of %s stopped", color.Cyan(result.Service.Name))
+		log.Printf("Error: %v", result.Err)
+
+		if useSentry {
+			sentry.CaptureException(result.Err)
+		}
+	}
+
+	if checkDrainedFailed {
+		log.Println(color.Yellow("The rollback was successful but some of the newer versions are still running"))
+		log.Println(color.Yellow("Please investigate why this is the case"))
+		// Do any cleanup manually since we are calling Exit and therefore defer won't run
+		cleanup()
+		// Exit code 2 to signal that this wasn't a successful deploy but it also wasn't a certain failure
+		os.Exit(2)
+	} else {
+		sendStatsdEvents(services, "gehen.rollbacks.completed", "Gehen successfully rolled back %s")
+	}
+
+	// Need to rollback scheduled tasks though since they will likely fail as well
+	// Also they would have inconsitent versions
+	rollbackScheduledTaskResults := deploy.RollbackScheduledTasks(ctx, scheduledTasks, clients, clients)
+	rollbackScheduledTasksFailed := false
+
+	for _, result := range rollbackScheduledTaskResults {
+		if result.Err == nil {
+			continue
+		}
+
+		rollbackScheduledTasksFailed = true
+		log.Printf(
+			"Failed to roll back scheduled task %s to version %s",
+			color.Cyan(result.Task.Name),
+			color.Magenta(result.Task.PreviousGitsha),
+		)
+		log.Printf("Error: %v", result.Err)
+
+		if useSentry {
+			sentry.CaptureException(result.Err)
+		}
+	}
+
+	if rollbackScheduledTasksFailed {
+		fatal.Exit(color.Red("Failed to roll back some scheduled tasks"))
+	}
+}
+
+// exitIfRollbackCancelled exits if ctx was cancelled during a step of a rollback.
+func exitIfRollbackCancelled(ctx context.Context) {
+	if ctx.Err() == nil {
+		return
+	}
+	log.Println(color.Yellow("The rollback was cancelled, services may still be running either version"))
+	fatal.Exit(color.Red("🚨 Rollback cancelled 🚨"))
+}
+
+// performRollback rolls back the services and scheduled tasks after a failed deploy.
+// It always exits since the deploy failed.
+func performRollback(ctx context.Context, services []*config.Service, scheduledTasks []*config.ScheduledTask, clients *awsecs.Clients) {
+	rollback(ctx, services, scheduledTasks, clients)
+	fatal.Exit(color.Yellow("🚨 Finished rolling back services 🚨"))
+}
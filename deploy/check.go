@@ -0,0 +1,346 @@
+package deploy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TouchBistro/gehen/config"
+	"github.com/TouchBistro/goutils/color"
+	"github.com/pkg/errors"
+)
+
+// How long to wait for a response to a deploy check request if the service doesn't set a timeout.
+const defaultCheckRequestTimeout = 10 * time.Second
+
+// checkTimeout returns how long to wait for each deploy check of a service.
+func checkTimeout(check config.Check) time.Duration {
+	if check.Timeout != 0 {
+		return check.Timeout
+	}
+	return defaultCheckRequestTimeout
+}
+
+// newTLSConfig creates the TLS config used for the deploy checks of a service.
+// It returns nil if the defaults should be used.
+func newTLSConfig(check config.Check) (*tls.Config, error) {
+	if check.CABundle == "" && !check.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: check.InsecureSkipVerify}
+	if check.CABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := ioutil.ReadFile(check.CABundle)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read CA bundle %s", check.CABundle)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in CA bundle %s", check.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// newCheckClient creates the HTTP client used for the deploy checks of a service.
+func newCheckClient(check config.Check) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(check)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Timeout: checkTimeout(check), Transport: transport}, nil
+}
+
+// httpChecker checks the version a service's URL is showing.
+type httpChecker struct {
+	client *http.Client
+	url    string
+}
+
+func (c *httpChecker) Check(ctx context.Context, service *config.Service) (bool, error) {
+	fetchedSha, err := fetchRevisionSha(ctx, c.client, c.url, service.Check)
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Got %s from %s\n", color.Magenta(fetchedSha), color.Blue(c.url))
+	return isGitsha(fetchedSha, service.Gitsha), nil
+}
+
+func (c *httpChecker) String() string {
+	return c.url
+}
+
+// runChecker runs a single deploy check of the service.
+// ok is false if the check could not tell which version is running.
+func runChecker(ctx context.Context, checker Checker, service *config.Service) (deployed, ok bool) {
+	checkCtx, cancel := context.WithTimeout(ctx, checkTimeout(service.Check))
+	defer cancel()
+
+	deployed, err := checker.Check(checkCtx, service)
+	if ctx.Err() != nil {
+		// Stopped polling, the error is handled by poll
+		return false, false
+	}
+	if err != nil {
+		log.Printf("Could not get a Git SHA version from %s\n", color.Blue(checker.String()))
+		log.Printf("Error: %v", err)
+		return false, false
+	}
+	return deployed, true
+}
+
+// checkQuorum runs every checker of the service once and reports whether enough of them
+// showed the new version to meet the quorum. The responses are recorded in state if it is not nil.
+func checkQuorum(ctx context.Context, checkers []Checker, service *config.Service, state *deployCheckState) bool {
+	quorum := serviceQuorum(service, checkers)
+
+	// Every target is checked each time so the quorum is based on what they all show right now
+	deployed := 0
+	for _, checker := range checkers {
+		checkerDeployed, ok := runChecker(ctx, checker, service)
+		if !ok {
+			continue
+		}
+		if state != nil {
+			state.recordResponse(checkerDeployed)
+		}
+		if checkerDeployed {
+			deployed++
+		}
+	}
+
+	if len(checkers) > 1 && ctx.Err() == nil {
+		log.Printf(
+			"%d of %d URLs showing version %s for %s, %d required\n",
+			deployed,
+			len(checkers),
+			color.Magenta(service.Gitsha),
+			color.Cyan(service.Name),
+			quorum,
+		)
+	}
+	return deployed >= quorum
+}
+
+// checkDegraded runs every checker of the service once and reports whether enough of them showed
+// another version that the quorum can't be met. Checkers that could not get a version, for example
+// because of a timeout or a 502 from the load balancer, are not counted against the service.
+func checkDegraded(ctx context.Context, checkers []Checker, service *config.Service) bool {
+	otherVersion := 0
+	for _, checker := range checkers {
+		deployed, ok := runChecker(ctx, checker, service)
+		if ok && !deployed {
+			otherVersion++
+		}
+	}
+	return len(checkers)-otherVersion < serviceQuorum(service, checkers)
+}
+
+// serviceQuorum returns how many of the checkers must show the new version.
+func serviceQuorum(service *config.Service, checkers []Checker) int {
+	if service.Quorum == 0 {
+		return len(checkers)
+	}
+	return service.Quorum
+}
+
+// isGitsha reports whether version is gitsha or a prefix of it long enough to be unambiguous.
+func isGitsha(version, gitsha string) bool {
+	return len(version) > 7 && strings.HasPrefix(gitsha, version)
+}
+
+// deployCheckState tracks the results of a service's deploy check across polls
+// to decide when the new version can be considered deployed.
+type deployCheckState struct {
+	successThreshold   int
+	noOldVersionInLast int
+	// Number of consecutive polls where the quorum was met
+	successes int
+	// Whether each of the most recent responses showed the new version, oldest first
+	recent []bool
+}
+
+func newDeployCheckState(check config.Check) *deployCheckState {
+	threshold := check.SuccessThreshold
+	if threshold == 0 {
+		threshold = 1
+	}
+	return &deployCheckState{successThreshold: threshold, noOldVersionInLast: check.NoOldVersionInLast}
+}
+
+// recordResponse records whether a response showed the new version.
+func (s *deployCheckState) recordResponse(deployed bool) {
+	if s.noOldVersionInLast == 0 {
+		return
+	}
+	s.recent = append(s.recent, deployed)
+	if len(s.recent) > s.noOldVersionInLast {
+		s.recent = s.recent[1:]
+	}
+}
+
+// recordPoll records whether the quorum was met on a poll and returns
+// true once the service is considered deployed.
+func (s *deployCheckState) recordPoll(quorumMet bool) bool {
+	if !quorumMet {
+		s.successes = 0
+		return false
+	}
+	s.successes++
+	if s.successes < s.successThreshold {
+		return false
+	}
+
+	if len(s.recent) < s.noOldVersionInLast {
+		return false
+	}
+	for _, deployed := range s.recent {
+		if !deployed {
+			return false
+		}
+	}
+	return true
+}
+
+func fetchRevisionSha(ctx context.Context, client *http.Client, url string, check config.Check) (string, error) {
+	method := check.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to create request for %s", url)
+	}
+	for name, value := range check.Headers {
+		// The Host header is ignored by net/http, it has to be set on the request
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to HTTP %s %s", method, url)
+	}
+
+	// Check status
+	if resp.StatusCode != 200 {
+		return "", errors.Errorf("Received non 200 status from %s", url)
+	}
+
+	if check.Header == "" && check.Regex == nil && check.JSONPointer == "" {
+		return defaultRevisionSha(resp)
+	}
+
+	var version string
+	if check.Header != "" {
+		version = resp.Header.Get(check.Header)
+		if version == "" {
+			return "", errors.Errorf("No %s header in response from %s", check.Header, url)
+		}
+	} else {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", errors.Errorf("Failed to parse body from %s", url)
+		}
+		version = string(body)
+	}
+
+	if check.JSONPointer != "" {
+		version, err = resolveJSONPointer([]byte(version), check.JSONPointer)
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed to get version from body of %s", url)
+		}
+	}
+
+	if check.Regex != nil {
+		matches := check.Regex.FindStringSubmatch(version)
+		if matches == nil {
+			return "", errors.Errorf("Version from %s does not match %s", url, check.Regex)
+		}
+		version = matches[1]
+	}
+
+	return strings.TrimSpace(version), nil
+}
+
+// defaultRevisionSha gets the revision sha from the Server header or the body.
+func defaultRevisionSha(resp *http.Response) (string, error) {
+	// Check if revision sha is in the http Server header.
+	if header := resp.Header.Get("Server"); header != "" {
+		t := strings.Split(header, "-")
+		if len(t) > 1 {
+			return t[len(t)-1], nil
+		}
+	}
+
+	// Check if revision sha is in the body
+	bodySha, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Errorf("Failed to parse body from %s", resp.Request.URL)
+	}
+
+	return string(bodySha), nil
+}
+
+// resolveJSONPointer returns the string value in the JSON document at the given pointer.
+// See RFC 6901 for the pointer syntax.
+func resolveJSONPointer(data []byte, pointer string) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return "", errors.Wrap(err, "body is not valid JSON")
+	}
+
+	// The pointer is validated when the config is read so it always starts with a /
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			value, ok = v[token]
+			if !ok {
+				return "", errors.Errorf("no value at %s", pointer)
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", errors.Errorf("no value at %s", pointer)
+			}
+			value = v[i]
+		default:
+			return "", errors.Errorf("no value at %s", pointer)
+		}
+	}
+
+	version, ok := value.(string)
+	if !ok {
+		return "", errors.Errorf("value at %s is not a string", pointer)
+	}
+	return version, nil
+}
@@ -0,0 +1,167 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/TouchBistro/gehen/awsecs"
+	"github.com/TouchBistro/gehen/config"
+	"github.com/TouchBistro/goutils/color"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// Checker checks whether a service is running the version being deployed.
+// The String method describes what is being checked for logs.
+type Checker interface {
+	fmt.Stringer
+	// Check returns true if the service is running service.Gitsha.
+	// An error means the check could not tell which version is running.
+	Check(ctx context.Context, service *config.Service) (bool, error)
+}
+
+// newCheckers returns the checkers used for the deploy check of the service.
+// client is used for checking URLs. If the service has no deploy check set,
+// the deployment is verified using the state of its tasks in ECS.
+func newCheckers(service *config.Service, client *http.Client, ecsClients awsecs.ECSClientProvider) ([]Checker, error) {
+	var checkers []Checker
+	for _, url := range service.CheckURLs() {
+		checkers = append(checkers, &httpChecker{client: client, url: url})
+	}
+
+	check := service.Check
+	switch {
+	case check.TCP != "":
+		checkers = append(checkers, tcpChecker(check.TCP))
+	case check.GRPC != nil:
+		creds := insecure.NewCredentials()
+		if check.GRPC.TLS {
+			tlsConfig, err := newTLSConfig(check)
+			if err != nil {
+				return nil, err
+			}
+			creds = credentials.NewTLS(tlsConfig)
+		}
+		checkers = append(checkers, &grpcChecker{check: *check.GRPC, creds: creds})
+	case len(check.Command) > 0:
+		checkers = append(checkers, commandChecker(check.Command))
+	case len(checkers) == 0:
+		checkers = append(checkers, &ecsTaskChecker{ecsClients.ECSClient(service.Region, service.Role)})
+	}
+	return checkers, nil
+}
+
+// ecsTaskChecker checks that the tasks of a service in ECS are running the new version.
+type ecsTaskChecker struct {
+	ecsClient awsecs.ECSClient
+}
+
+func (c *ecsTaskChecker) Check(ctx context.Context, service *config.Service) (bool, error) {
+	return awsecs.CheckTasksDeployed(ctx, service, c.ecsClient)
+}
+
+func (c *ecsTaskChecker) String() string {
+	return "ECS tasks"
+}
+
+// tcpChecker checks that an address accepts TCP connections.
+// There is no way to get a version so any connection counts as deployed.
+type tcpChecker string
+
+func (c tcpChecker) Check(ctx context.Context, service *config.Service) (bool, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", string(c))
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to connect to %s", string(c))
+	}
+	conn.Close()
+
+	log.Printf("Connected to %s\n", color.Blue(c.String()))
+	return true, nil
+}
+
+func (c tcpChecker) String() string {
+	return "tcp://" + string(c)
+}
+
+// grpcChecker checks a service using the gRPC health checking protocol.
+// The version is read from the response header metadata.
+type grpcChecker struct {
+	check config.GRPCCheck
+	creds credentials.TransportCredentials
+}
+
+func (c *grpcChecker) Check(ctx context.Context, service *config.Service) (bool, error) {
+	conn, err := grpc.DialContext(ctx, c.check.Address, grpc.WithTransportCredentials(c.creds))
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to connect to %s", c.check.Address)
+	}
+	defer conn.Close()
+
+	var header metadata.MD
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(
+		ctx,
+		&grpc_health_v1.HealthCheckRequest{Service: c.check.Service},
+		grpc.Header(&header),
+	)
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to check health of %s", c.check.Address)
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return false, errors.Errorf("%s is %s", c.check.Address, resp.Status)
+	}
+
+	values := header.Get(c.check.VersionMetadata)
+	if len(values) == 0 {
+		return false, errors.Errorf("No %s metadata in response from %s", c.check.VersionMetadata, c.check.Address)
+	}
+	version := strings.TrimSpace(values[0])
+
+	log.Printf("Got %s from %s\n", color.Magenta(version), color.Blue(c.String()))
+	return isGitsha(version, service.Gitsha), nil
+}
+
+func (c *grpcChecker) String() string {
+	if c.check.Service != "" {
+		return fmt.Sprintf("grpc://%s/%s", c.check.Address, c.check.Service)
+	}
+	return "grpc://" + c.check.Address
+}
+
+// commandChecker runs a local command whose stdout must contain the Git SHA.
+// The service name and Git SHA are passed in the GEHEN_SERVICE and GEHEN_GITSHA
+// environment variables.
+type commandChecker []string
+
+func (c commandChecker) Check(ctx context.Context, service *config.Service) (bool, error) {
+	cmd := exec.CommandContext(ctx, c[0], c[1:]...)
+	cmd.Env = append(os.Environ(), "GEHEN_SERVICE="+service.Name, "GEHEN_GITSHA="+service.Gitsha)
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to run %s", c)
+	}
+
+	if !strings.Contains(string(output), service.Gitsha) {
+		log.Printf("Output of %s does not contain %s\n", color.Blue(c.String()), color.Magenta(service.Gitsha))
+		return false, nil
+	}
+
+	log.Printf("Output of %s contains %s\n", color.Blue(c.String()), color.Magenta(service.Gitsha))
+	return true, nil
+}
+
+func (c commandChecker) String() string {
+	return strings.Join(c, " ")
+}
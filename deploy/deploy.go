@@ -2,9 +2,7 @@ package deploy
 
 import (
 	"context"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"strings"
 	"time"
 
@@ -25,8 +23,12 @@ var (
 // for a service to deploy or drain.
 var ErrTimedOut = errors.New("deploy: timed out while checking for event")
 
-// ErrNoDeployCheckURL is returned by CheckDeployed if the service has no URL set.
-var ErrNoDeployCheckURL = errors.New("deploy: service has no URL to check deployment")
+// ErrDegraded is returned by Bake if the deploy check of a service started showing another version.
+var ErrDegraded = errors.New("deploy: service degraded while baking")
+
+// ErrCancelled is returned if the context was cancelled while waiting
+// for a service to deploy or drain.
+var ErrCancelled = errors.New("deploy: cancelled while checking for event")
 
 // Result represents the result of a deploy action.
 // If the action failed err will be non-nil.
@@ -36,27 +38,28 @@ type Result struct {
 }
 
 // TimeoutDuration sets the duration to wait for CheckDeployed and CheckDrained
-// before timing out.
+// before timing out. It is used for services that do not set their own timeout.
 // Default is 10 minutes.
 func TimeoutDuration(d time.Duration) {
 	timeoutDuration = d
 }
 
 // CheckIntervalDuration sets the duration of how frequently to check
-// if a service has deployed or drained.
+// if a service has deployed or drained. It is used for services that do not
+// set their own check interval.
 // Default is 15 seconds.
 func CheckIntervalDuration(d time.Duration) {
 	checkIntervalDuration = d
 }
 
 // Deploy will deploy the given services to AWS ECS.
-func Deploy(ctx context.Context, services []*config.Service, ecsClient awsecs.ECSClient) []Result {
+func Deploy(ctx context.Context, services []*config.Service, ecsClients awsecs.ECSClientProvider, cdClients awsecs.CDClientProvider) []Result {
 	resultChan := make(chan Result)
 
 	// Deploy all the services concurrently
 	for _, s := range services {
 		go func(service *config.Service) {
-			err := awsecs.Deploy(ctx, service, ecsClient)
+			err := awsecs.Deploy(ctx, service, ecsClients.ECSClient(service.Region, service.Role), cdClients.CDClient(service.Region, service.Role))
 			resultChan <- Result{service, err}
 		}(s)
 	}
@@ -70,7 +73,28 @@ func Deploy(ctx context.Context, services []*config.Service, ecsClient awsecs.EC
 	return results
 }
 
-func Rollback(ctx context.Context, services []*config.Service, ecsClient awsecs.ECSClient) []Result {
+// PrepareRollback sets up the services so that Rollback will roll them back to an earlier revision.
+// to is a task definition, a Git SHA or empty to use the preceding revision, see awsecs.PrepareRollback.
+func PrepareRollback(ctx context.Context, services []*config.Service, to string, maxRevisions int, ecsClients awsecs.ECSClientProvider) []Result {
+	resultChan := make(chan Result)
+
+	for _, s := range services {
+		go func(service *config.Service) {
+			err := awsecs.PrepareRollback(ctx, service, to, maxRevisions, ecsClients.ECSClient(service.Region, service.Role))
+			resultChan <- Result{service, err}
+		}(s)
+	}
+
+	results := make([]Result, len(services))
+	for i := 0; i < len(services); i++ {
+		results[i] = <-resultChan
+	}
+
+	return results
+}
+
+// Rollback will roll back the given services to their previous version.
+func Rollback(ctx context.Context, services []*config.Service, ecsClients awsecs.ECSClientProvider, cdClients awsecs.CDClientProvider) []Result {
 	resultChan := make(chan Result)
 
 	// Rollback all the services concurrently
@@ -85,7 +109,7 @@ func Rollback(ctx context.Context, services []*config.Service, ecsClient awsecs.
 		s.TaskDefinitionARN = taskDefARN
 
 		go func(service *config.Service) {
-			err := awsecs.UpdateService(ctx, service, ecsClient)
+			err := awsecs.UpdateService(ctx, service, ecsClients.ECSClient(service.Region, service.Role), cdClients.CDClient(service.Region, service.Role))
 			resultChan <- Result{service, err}
 		}(s)
 	}
@@ -99,69 +123,69 @@ func Rollback(ctx context.Context, services []*config.Service, ecsClient awsecs.
 }
 
 // CheckDeployed keeps pinging the services until it sees the new version has been deployed
-// or it times out. If a service timed out Result.err will be ErrTimedOut.
-func CheckDeployed(services []*config.Service) []Result {
-	resultChan := make(chan Result)
+// or it times out. Services with no URL or other deploy check set are checked using the
+// state of their tasks in ECS. If a service timed out Result.err will be ErrTimedOut.
+// If ctx is cancelled Result.err will be ErrCancelled.
+func CheckDeployed(ctx context.Context, services []*config.Service, ecsClients awsecs.ECSClientProvider) []Result {
+	// Buffered so goroutines never block if the results stop being read
+	resultChan := make(chan Result, len(services))
 
 	for _, s := range services {
 		go func(service *config.Service) {
-			// If service has no URL set, skip deploy check
-			if service.URL == "" {
-				log.Printf("Skipping deploy check for %s because no URL is set", color.Cyan(service.Name))
-				resultChan <- Result{service, ErrNoDeployCheckURL}
+			client, err := newCheckClient(service.Check)
+			if err != nil {
+				resultChan <- Result{service, err}
 				return
 			}
+			defer client.CloseIdleConnections()
 
-			log.Printf("Checking %s for newly deployed version of %s\n", color.Blue(service.URL), color.Cyan(service.Name))
+			checkers, err := newCheckers(service, client, ecsClients)
+			if err != nil {
+				resultChan <- Result{service, err}
+				return
+			}
 
-			for {
-				time.Sleep(checkIntervalDuration)
+			targets := make([]string, len(checkers))
+			for i, checker := range checkers {
+				targets[i] = checker.String()
+			}
+			log.Printf("Checking %s for newly deployed version of %s\n", color.Blue(strings.Join(targets, ", ")), color.Cyan(service.Name))
 
-				fetchedSha, err := fetchRevisionSha(service.URL)
-				if err != nil {
-					log.Printf("Could not parse a Git SHA version from header or body at %s\n", color.Blue(service.URL))
-					log.Printf("Error: %v", err)
-					continue
+			state := newDeployCheckState(service.Check)
+			err = poll(ctx, service, func(ctx context.Context) (bool, error) {
+				quorumMet := checkQuorum(ctx, checkers, service, state)
+				if ctx.Err() != nil {
+					return false, nil
 				}
 
-				log.Printf("Got %s from %s\n", color.Magenta(fetchedSha), color.Blue(service.URL))
-				if len(fetchedSha) > 7 && strings.HasPrefix(service.Gitsha, fetchedSha) {
-					resultChan <- Result{Service: service}
-					return
+				done := state.recordPoll(quorumMet)
+				if !done && state.successes > 0 {
+					log.Printf(
+						"Version %s seen on %s %d of %d times in a row\n",
+						color.Magenta(service.Gitsha),
+						color.Cyan(service.Name),
+						state.successes,
+						state.successThreshold,
+					)
 				}
-			}
+				return done, nil
+			})
+			resultChan <- Result{service, err}
 		}(s)
 	}
 
-	// Set of service names that completed the deploy check
-	completedServices := make(map[string]bool)
-	var results []Result
-
-loop:
+	// Each service times out on its own so we are guaranteed to get a result for each one
+	results := make([]Result, 0, len(services))
 	for i := 0; i < len(services); i++ {
-		select {
-		case result := <-resultChan:
-			if result.Err != nil {
-				log.Printf(
-					"Traffic showing version %s on %s, waiting for old versions to stop...\n",
-					color.Green(result.Service.Gitsha),
-					color.Cyan(result.Service.Name),
-				)
-			}
-			completedServices[result.Service.Name] = true
-			results = append(results, result)
-		case <-time.After(timeoutDuration):
-			// Stop looping, anything that didn't succeed has now failed
-			break loop
-		}
-	}
-
-	// Figure out which, if any, services timed out
-	for _, s := range services {
-		completed := completedServices[s.Name]
-		if !completed {
-			results = append(results, Result{s, ErrTimedOut})
+		result := <-resultChan
+		if result.Err == nil {
+			log.Printf(
+				"Traffic showing version %s on %s, waiting for old versions to stop...\n",
+				color.Green(result.Service.Gitsha),
+				color.Cyan(result.Service.Name),
+			)
 		}
+		results = append(results, result)
 	}
 
 	return results
@@ -169,58 +193,241 @@ loop:
 
 // CheckDrained keeps checking the services until it sees all old versions are gone
 // or it times out. If a service timed out Result.err will be ErrTimedOut.
-func CheckDrained(ctx context.Context, services []*config.Service, ecsClient awsecs.ECSClient) []Result {
-	resultChan := make(chan Result)
+// If ctx is cancelled Result.err will be ErrCancelled.
+func CheckDrained(ctx context.Context, services []*config.Service, ecsClients awsecs.ECSClientProvider, elbClients awsecs.ELBClientProvider, cdClients awsecs.CDClientProvider) []Result {
+	// Buffered so goroutines never block if the results stop being read
+	resultChan := make(chan Result, len(services))
 
 	for _, s := range services {
 		go func(service *config.Service) {
-			for {
-				time.Sleep(checkIntervalDuration)
+			ecsClient := ecsClients.ECSClient(service.Region, service.Role)
+			elbClient := elbClients.ELBClient(service.Region, service.Role)
+			cdClient := cdClients.CDClient(service.Region, service.Role)
+			err := poll(ctx, service, func(ctx context.Context) (bool, error) {
 				log.Printf("Checking if old versions are gone for: %s\n", color.Cyan(service.Name))
-
-				drained, err := awsecs.CheckDrain(ctx, service, ecsClient)
-				if err != nil {
-					// If this happens abort because it will never succeed
-					resultChan <- Result{service, err}
-					return
+				drained, err := awsecs.CheckDrain(ctx, service, ecsClient, elbClient, cdClient)
+				if retryLater(service, err) {
+					return false, nil
 				}
+				// Any other error aborts because it will never succeed
+				return drained, err
+			})
+			resultChan <- Result{service, err}
+		}(s)
+	}
 
-				if !drained {
-					continue
-				}
+	// Each service times out on its own so we are guaranteed to get a result for each one
+	results := make([]Result, 0, len(services))
+	for i := 0; i < len(services); i++ {
+		result := <-resultChan
+		if result.Err == nil {
+			log.Printf("Version %s successfully deployed to %s\n", color.Green(result.Service.Gitsha), color.Cyan(result.Service.Name))
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// Bake keeps checking the services for their bake duration once they have been deployed.
+// Each time the deploy check and the container health checks are run and the CloudWatch alarms
+// of the service are checked. Services with no bake duration are skipped.
+//
+// If the deploy check showed another version as many times in a row as its success threshold
+// Result.err will wrap ErrDegraded. Checks that failed to get a version are not counted.
+// If a container health check failed it will wrap awsecs.ErrHealthcheckFailed and
+// if an alarm went into the ALARM state after since it will wrap awsecs.ErrAlarm.
+// If ctx is cancelled Result.err will be ErrCancelled.
+func Bake(ctx context.Context, services []*config.Service, since time.Time, ecsClients awsecs.ECSClientProvider, cwClients awsecs.CWClientProvider) []Result {
+	// Buffered so goroutines never block if the results stop being read
+	resultChan := make(chan Result, len(services))
+
+	for _, s := range services {
+		go func(service *config.Service) {
+			if service.BakeDuration == 0 {
+				resultChan <- Result{service, nil}
+				return
+			}
+
+			client, err := newCheckClient(service.Check)
+			if err != nil {
+				resultChan <- Result{service, err}
+				return
+			}
+			defer client.CloseIdleConnections()
 
-				resultChan <- Result{Service: service}
+			checkers, err := newCheckers(service, client, ecsClients)
+			if err != nil {
+				resultChan <- Result{service, err}
 				return
 			}
+
+			log.Printf("Baking %s for %s\n", color.Cyan(service.Name), service.BakeDuration)
+			ecsClient := ecsClients.ECSClient(service.Region, service.Role)
+			cwClient := cwClients.CWClient(service.Region, service.Role)
+			failureThreshold := service.Check.SuccessThreshold
+			if failureThreshold == 0 {
+				failureThreshold = 1
+			}
+			failures := 0
+			err = bake(ctx, service, func(ctx context.Context) error {
+				if err := awsecs.CheckAlarms(ctx, service, since, cwClient); err != nil && !retryLater(service, err) {
+					return err
+				}
+				if err := awsecs.CheckHealth(ctx, service, ecsClient); err != nil && !retryLater(service, err) {
+					return err
+				}
+
+				if !checkDegraded(ctx, checkers, service) {
+					failures = 0
+					return nil
+				}
+				if ctx.Err() != nil {
+					return nil
+				}
+				failures++
+				if failures >= failureThreshold {
+					return errors.Wrapf(ErrDegraded, "deploy check showed another version %d times in a row", failures)
+				}
+				log.Printf(
+					"Deploy check of %s showed another version %d of %d times in a row\n",
+					color.Cyan(service.Name),
+					failures,
+					failureThreshold,
+				)
+				return nil
+			})
+			resultChan <- Result{service, err}
 		}(s)
 	}
 
-	// Set of service names that finished the check
-	finishedServices := make(map[string]bool)
 	results := make([]Result, 0, len(services))
-
-loop:
 	for i := 0; i < len(services); i++ {
+		result := <-resultChan
+		if result.Err == nil && result.Service.BakeDuration != 0 {
+			log.Printf("Finished baking %s\n", color.Cyan(result.Service.Name))
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// bake calls check every check interval of the service until the bake duration of the
+// service has passed or check returns an error. check is always called at least once.
+// ErrCancelled is returned if ctx was cancelled.
+func bake(ctx context.Context, service *config.Service, check func(ctx context.Context) error) error {
+	deadline := time.Now().Add(service.BakeDuration)
+
+	ticker := time.NewTicker(serviceCheckInterval(service))
+	defer ticker.Stop()
+
+	for {
+		err := check(ctx)
+		if ctx.Err() != nil {
+			return ErrCancelled
+		}
+		if err != nil || !time.Now().Before(deadline) {
+			return err
+		}
+
 		select {
-		case result := <-resultChan:
-			if result.Err != nil {
-				log.Printf("Version %s successfully deployed to %s\n", color.Green(result.Service.Gitsha), color.Cyan(result.Service.Name))
-			}
-			finishedServices[result.Service.Name] = true
-			results = append(results, result)
-		case <-time.After(timeoutDuration):
-			// Stop looping, anything that didn't succeed has now failed
-			break loop
+		case <-ctx.Done():
+			return ErrCancelled
+		case <-ticker.C:
 		}
 	}
+}
 
-	// Figure out which, if any, services timed out
-	for _, s := range services {
-		if finished := finishedServices[s.Name]; !finished {
-			result := Result{s, ErrTimedOut}
-			results = append(results, result)
+// poll calls check every check interval of the service until it returns true or an error.
+// The service timeout is a deadline from when poll is called, ctx passed to check is
+// cancelled when it is reached so in flight requests are stopped as well.
+// ErrTimedOut is returned if the deadline was reached and ErrCancelled if ctx was cancelled.
+func poll(ctx context.Context, service *config.Service, check func(ctx context.Context) (bool, error)) error {
+	deadlineCtx, cancel := context.WithTimeout(ctx, serviceTimeout(service))
+	defer cancel()
+
+	ticker := time.NewTicker(serviceCheckInterval(service))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-deadlineCtx.Done():
+			return pollErr(ctx)
+		case <-ticker.C:
+		}
+
+		done, err := check(deadlineCtx)
+		if deadlineCtx.Err() != nil {
+			// The check was interrupted so its result can't be trusted
+			return pollErr(ctx)
+		}
+		if err != nil || done {
+			return err
 		}
 	}
+}
+
+// retryLater reports whether err is a retryable AWS error, such as throttling, that persisted through
+// the retries of the AWS client. Checks failing with one are tried again on their next interval
+// instead of failing the service.
+func retryLater(service *config.Service, err error) bool {
+	if err == nil || !awsecs.IsRetryable(err) {
+		return false
+	}
+	log.Printf("Check of %s failed with a retryable AWS error, trying again next interval: %v\n", color.Cyan(service.Name), err)
+	return true
+}
+
+// pollErr returns the error for a poll that stopped before its check succeeded.
+// If ctx is done the caller cancelled the poll, otherwise the deadline was reached.
+func pollErr(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ErrCancelled
+	}
+	return ErrTimedOut
+}
+
+// serviceTimeout returns how long to wait for the service to deploy or drain.
+func serviceTimeout(service *config.Service) time.Duration {
+	if service.TimeoutDuration != 0 {
+		return service.TimeoutDuration
+	}
+	return timeoutDuration
+}
+
+// serviceCheckInterval returns how frequently to check if the service has deployed or drained.
+func serviceCheckInterval(service *config.Service) time.Duration {
+	if service.CheckIntervalDuration != 0 {
+		return service.CheckIntervalDuration
+	}
+	return checkIntervalDuration
+}
+
+// DiagnosisResult represents the result of diagnosing a failed service.
+// If the diagnosis could not be collected err will be non-nil.
+type DiagnosisResult struct {
+	Service   *config.Service
+	Diagnosis awsecs.Diagnosis
+	Err       error
+}
+
+// Diagnose collects the stopped and unhealthy tasks, latest events and task logs of the given services
+// to help find out why they failed, see awsecs.Diagnose.
+func Diagnose(ctx context.Context, services []*config.Service, ecsClients awsecs.ECSClientProvider, logsClients awsecs.LogsClientProvider) []DiagnosisResult {
+	resultChan := make(chan DiagnosisResult, len(services))
+
+	for _, s := range services {
+		go func(service *config.Service) {
+			diagnosis, err := awsecs.Diagnose(ctx, service, ecsClients.ECSClient(service.Region, service.Role), logsClients)
+			resultChan <- DiagnosisResult{service, diagnosis, err}
+		}(s)
+	}
+
+	results := make([]DiagnosisResult, len(services))
+	for i := 0; i < len(services); i++ {
+		results[i] = <-resultChan
+	}
 
 	return results
 }
@@ -233,7 +440,7 @@ type ScheduledTaskResult struct {
 }
 
 // UpdateScheduledTasks will update the ECS scheduled tasks to use the new version of the service.
-func UpdateScheduledTasks(ctx context.Context, tasks []*config.ScheduledTask, ebClient awsecs.EBClient, ecsClient awsecs.ECSClient) []ScheduledTaskResult {
+func UpdateScheduledTasks(ctx context.Context, tasks []*config.ScheduledTask, ebClients awsecs.EBClientProvider, ecsClients awsecs.ECSClientProvider) []ScheduledTaskResult {
 	resultChan := make(chan ScheduledTaskResult)
 
 	// Update all the tasks concurrently
@@ -241,8 +448,8 @@ func UpdateScheduledTasks(ctx context.Context, tasks []*config.ScheduledTask, eb
 		go func(task *config.ScheduledTask) {
 			err := awsecs.UpdateScheduledTask(ctx, awsecs.UpdateScheduledTaskArgs{
 				Task:      task,
-				EBClient:  ebClient,
-				ECSClient: ecsClient,
+				EBClient:  ebClients.EBClient(task.Region, task.Role),
+				ECSClient: ecsClients.ECSClient(task.Region, task.Role),
 			})
 			resultChan <- ScheduledTaskResult{task, err}
 		}(t)
@@ -258,7 +465,7 @@ func UpdateScheduledTasks(ctx context.Context, tasks []*config.ScheduledTask, eb
 }
 
 // RollbackScheduledTasks will change the ECS scheduled tasks to use the previous version of the service.
-func RollbackScheduledTasks(ctx context.Context, tasks []*config.ScheduledTask, ebClient awsecs.EBClient, ecsClient awsecs.ECSClient) []ScheduledTaskResult {
+func RollbackScheduledTasks(ctx context.Context, tasks []*config.ScheduledTask, ebClients awsecs.EBClientProvider, ecsClients awsecs.ECSClientProvider) []ScheduledTaskResult {
 	resultChan := make(chan ScheduledTaskResult)
 
 	// Rollback all the task concurrently
@@ -268,8 +475,8 @@ func RollbackScheduledTasks(ctx context.Context, tasks []*config.ScheduledTask,
 				Task: task,
 				// The func will handle using the correct task def ARN, no need to swap ourselves
 				IsRollback: true,
-				EBClient:   ebClient,
-				ECSClient:  ecsClient,
+				EBClient:   ebClients.EBClient(task.Region, task.Role),
+				ECSClient:  ecsClients.ECSClient(task.Region, task.Role),
 			})
 			resultChan <- ScheduledTaskResult{task, err}
 		}(t)
@@ -282,36 +489,3 @@ func RollbackScheduledTasks(ctx context.Context, tasks []*config.ScheduledTask,
 
 	return results
 }
-
-func fetchRevisionSha(url string) (string, error) {
-	resp, err := http.Get(url)
-	if resp != nil {
-		defer resp.Body.Close()
-	}
-
-	if err != nil {
-		return "", errors.Wrapf(err, "Failed to HTTP GET %s", url)
-	}
-
-	// Check status
-	if resp.StatusCode != 200 {
-		return "", errors.Errorf("Received non 200 status from %s", url)
-	}
-
-	// Check if revision sha is in the http Server header.
-	if header := resp.Header.Get("Server"); header != "" {
-		// TODO: use a regular expression
-		t := strings.Split(header, "-")
-		if len(t) > 1 {
-			return t[len(t)-1], nil
-		}
-	}
-
-	// Check if revision sha is in the body
-	bodySha, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", errors.Errorf("Failed to parse body from %s", url)
-	}
-
-	return string(bodySha), nil
-}
@@ -2,19 +2,43 @@ package deploy_test
 
 import (
 	"context"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"regexp"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/TouchBistro/gehen/awsecs"
 	"github.com/TouchBistro/gehen/config"
 	"github.com/TouchBistro/gehen/deploy"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	cdtypes "github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	elbtypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 )
 
+// mockClients combines the mocks to provide all the clients needed by DeployStages.
+type mockClients struct {
+	*awsecs.MockECSClient
+	*awsecs.MockELBClient
+	*awsecs.MockCloudWatchClient
+	*awsecs.MockCodeDeployClient
+}
+
 func TestDeploy(t *testing.T) {
 	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
 	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
@@ -71,7 +95,7 @@ func TestDeploy(t *testing.T) {
 		},
 	}
 
-	results := deploy.Deploy(context.Background(), services, mockClient)
+	results := deploy.Deploy(context.Background(), services, mockClient, awsecs.NewMockCodeDeployClient(mockClient))
 
 	assert.ElementsMatch(t, expectedResults, results)
 }
@@ -131,11 +155,80 @@ func TestDeployNoNewTaskDef(t *testing.T) {
 		},
 	}
 
-	results := deploy.Deploy(context.Background(), services, mockClient)
+	results := deploy.Deploy(context.Background(), services, mockClient, awsecs.NewMockCodeDeployClient(mockClient))
 
 	assert.ElementsMatch(t, expectedResults, results)
 }
 
+func TestPlan(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+	services := []*config.Service{
+		{
+			Name:    "example-production",
+			Gitsha:  gitsha,
+			Cluster: "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+		},
+	}
+
+	mockClient := awsecs.NewMockECSClient(
+		[]string{"example-production"},
+		"example-service",
+		previousGitsha,
+	)
+
+	expectedResults := []deploy.PlanResult{
+		{
+			Service: services[0],
+			Plan: awsecs.TaskDefPlan{
+				CurrentTaskDefinitionARN: "arn:aws:ecs:us-east-1:123456:task-definition/example-production:1",
+				BaseTaskDefinitionARN:    "arn:aws:ecs:us-east-1:123456:task-definition/example-production:1",
+				PreviousGitsha:           previousGitsha,
+				Containers: []awsecs.ContainerPlan{
+					{
+						Name:     "example-service",
+						Image:    "123456.dkr.ecr.us-east-1.amazonaws.com/example-service:" + previousGitsha,
+						NewImage: "123456.dkr.ecr.us-east-1.amazonaws.com/example-service:" + gitsha,
+					},
+				},
+				NewRevision: true,
+			},
+		},
+	}
+
+	results := deploy.Plan(context.Background(), services, mockClient)
+
+	assert.Equal(t, expectedResults, results)
+	// Planning must not modify anything
+	assert.Empty(t, services[0].TaskDefinitionARN)
+	results = deploy.Plan(context.Background(), services, mockClient)
+	assert.Equal(t, expectedResults, results)
+}
+
+func TestPlanScheduledTasks(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	scheduledTasks := []*config.ScheduledTask{
+		{
+			Name:   "weekly-job",
+			Gitsha: gitsha,
+		},
+	}
+
+	mockECSClient := awsecs.NewMockECSClient(
+		[]string{"weekly-job"},
+		"example-service",
+		gitsha,
+	)
+	mockEBClient := awsecs.NewMockEventBridgeClient([]string{"weekly-job"})
+
+	results := deploy.PlanScheduledTasks(context.Background(), scheduledTasks, mockEBClient, mockECSClient)
+
+	assert.Len(t, results, 1)
+	assert.NoError(t, results[0].Err)
+	assert.False(t, results[0].Plan.NewRevision)
+	assert.Equal(t, gitsha, results[0].Plan.PreviousGitsha)
+}
+
 func TestRollback(t *testing.T) {
 	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
 	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
@@ -200,11 +293,184 @@ func TestRollback(t *testing.T) {
 		},
 	}
 
-	results := deploy.Rollback(context.Background(), services, mockClient)
+	results := deploy.Rollback(context.Background(), services, mockClient, awsecs.NewMockCodeDeployClient(mockClient))
 
 	assert.ElementsMatch(t, expectedResults, results)
 }
 
+func TestPrepareRollback(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+	services := []*config.Service{
+		{
+			Name:    "example-production",
+			Gitsha:  gitsha,
+			Cluster: "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+			URL:     "https://example.touchbistro.io/ping",
+		},
+	}
+
+	mockClient := awsecs.NewMockECSClient(
+		[]string{"example-production"},
+		"example-service",
+		previousGitsha,
+	)
+	deploy.Deploy(context.Background(), services, mockClient, awsecs.NewMockCodeDeployClient(mockClient))
+
+	results := deploy.PrepareRollback(
+		context.Background(),
+		services,
+		"arn:aws:ecs:us-east-1:123456:task-definition/example-production:1",
+		10,
+		mockClient,
+	)
+
+	expectedResults := []deploy.Result{
+		{
+			Service: &config.Service{
+				Name:                      "example-production",
+				Gitsha:                    gitsha,
+				Cluster:                   "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+				URL:                       "https://example.touchbistro.io/ping",
+				PreviousGitsha:            previousGitsha,
+				PreviousTaskDefinitionARN: "arn:aws:ecs:us-east-1:123456:task-definition/example-production:1",
+				TaskDefinitionARN:         "arn:aws:ecs:us-east-1:123456:task-definition/example-production:2",
+				Tags:                      []string{},
+			},
+			Err: nil,
+		},
+	}
+	assert.Equal(t, expectedResults, results)
+}
+
+func TestPrepareRollbackRevisions(t *testing.T) {
+	gitshas := []string{
+		"b6589fc6ab0dc82cf12099d1c2d40ab994e8410c",
+		"356a192b7913b04c54574d18c28d46e6395428ab",
+		"da39a3ee5e6b4b0d3255bfef95601890afd80709",
+	}
+	tests := []struct {
+		name               string
+		to                 string
+		expectedGitsha     string
+		expectedTaskDefARN string
+	}{
+		{"previous revision", "", gitshas[1], "arn:aws:ecs:us-east-1:123456:task-definition/example-production:2"},
+		{"gitsha", gitshas[0], gitshas[0], "arn:aws:ecs:us-east-1:123456:task-definition/example-production:1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := awsecs.NewMockECSClient(
+				[]string{"example-production"},
+				"example-service",
+				gitshas[0],
+			)
+			// Deploy twice so the service is using revision 3
+			for _, gitsha := range gitshas[1:] {
+				deploy.Deploy(context.Background(), []*config.Service{
+					{
+						Name:    "example-production",
+						Gitsha:  gitsha,
+						Cluster: "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+					},
+				}, mockClient, awsecs.NewMockCodeDeployClient(mockClient))
+			}
+
+			service := &config.Service{
+				Name:    "example-production",
+				Cluster: "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+			}
+			results := deploy.PrepareRollback(context.Background(), []*config.Service{service}, tt.to, 10, mockClient)
+
+			assert.NoError(t, results[0].Err)
+			assert.Equal(t, gitshas[2], service.Gitsha)
+			assert.Equal(t, "arn:aws:ecs:us-east-1:123456:task-definition/example-production:3", service.TaskDefinitionARN)
+			assert.Equal(t, tt.expectedGitsha, service.PreviousGitsha)
+			assert.Equal(t, tt.expectedTaskDefARN, service.PreviousTaskDefinitionARN)
+		})
+	}
+}
+
+func TestPrepareRollbackCurrentGitsha(t *testing.T) {
+	gitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+	services := []*config.Service{
+		{
+			Name:    "example-production",
+			Cluster: "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+		},
+	}
+
+	mockClient := awsecs.NewMockECSClient(
+		[]string{"example-production"},
+		"example-service",
+		gitsha,
+	)
+
+	results := deploy.PrepareRollback(context.Background(), services, gitsha, 10, mockClient)
+
+	assert.Len(t, results, 1)
+	assert.Error(t, results[0].Err)
+}
+
+func TestPrepareRollbackMaxRevisions(t *testing.T) {
+	oldGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+	services := []*config.Service{
+		{
+			Name:    "example-production",
+			Cluster: "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+		},
+	}
+
+	mockClient := awsecs.NewMockECSClient(
+		[]string{"example-production"},
+		"example-service",
+		oldGitsha,
+	)
+	for _, gitsha := range []string{"356a192b7913b04c54574d18c28d46e6395428ab", "da39a3ee5e6b4b0d3255bfef95601890afd80709"} {
+		deploy.Deploy(context.Background(), []*config.Service{
+			{
+				Name:    "example-production",
+				Gitsha:  gitsha,
+				Cluster: "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+			},
+		}, mockClient, awsecs.NewMockCodeDeployClient(mockClient))
+	}
+
+	// The revision using oldGitsha is the third newest so it won't be found
+	results := deploy.PrepareRollback(context.Background(), services, oldGitsha, 2, mockClient)
+
+	assert.Len(t, results, 1)
+	assert.Error(t, results[0].Err)
+	assert.Contains(t, results[0].Err.Error(), "newest 2 revisions")
+}
+
+func TestPrepareRollbackWrongFamily(t *testing.T) {
+	services := []*config.Service{
+		{
+			Name:    "example-production",
+			Cluster: "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+		},
+	}
+
+	mockClient := awsecs.NewMockECSClient(
+		[]string{"example-production", "example-staging"},
+		"example-service",
+		"b6589fc6ab0dc82cf12099d1c2d40ab994e8410c",
+	)
+
+	results := deploy.PrepareRollback(
+		context.Background(),
+		services,
+		"arn:aws:ecs:us-east-1:123456:task-definition/example-staging:1",
+		10,
+		mockClient,
+	)
+
+	assert.Len(t, results, 1)
+	assert.Error(t, results[0].Err)
+}
+
 func TestCheckDeployed(t *testing.T) {
 	deploy.TimeoutDuration(3 * time.Second)
 	deploy.CheckIntervalDuration(250 * time.Millisecond)
@@ -257,11 +523,235 @@ func TestCheckDeployed(t *testing.T) {
 		},
 	}
 
-	results := deploy.CheckDeployed(services)
+	results := deploy.CheckDeployed(context.Background(), services, nil)
 
 	assert.ElementsMatch(t, expectedResults, results)
 }
 
+func TestCheckDeployedCustomCheck(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(250 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+
+	jsonServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"version":{"commit":"%s"}}`, gitsha)
+	}))
+	defer jsonServer.Close()
+
+	headerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-App-Revision", "example-"+gitsha)
+		fmt.Fprint(w, "OK")
+	}))
+	defer headerServer.Close()
+
+	services := []*config.Service{
+		{
+			Name:   "example-production",
+			Gitsha: gitsha,
+			URL:    jsonServer.URL,
+			Check:  config.Check{JSONPointer: "/version/commit"},
+		},
+		{
+			Name:   "example-staging",
+			Gitsha: gitsha,
+			URL:    headerServer.URL,
+			Check: config.Check{
+				Header: "X-App-Revision",
+				Regex:  regexp.MustCompile(`^example-(\w+)$`),
+			},
+		},
+	}
+
+	results := deploy.CheckDeployed(context.Background(), services, nil)
+
+	assert.Len(t, results, 2)
+	for _, r := range results {
+		assert.NoError(t, r.Err)
+	}
+}
+
+func TestCheckDeployedCustomRequest(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(250 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Host != "example.touchbistro.io" || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, gitsha)
+	}))
+	defer server.Close()
+
+	services := []*config.Service{
+		{
+			Name:   "example-production",
+			Gitsha: gitsha,
+			URL:    server.URL,
+			Check: config.Check{
+				Method: http.MethodPost,
+				Headers: map[string]string{
+					"Authorization": "Bearer secret",
+					"Host":          "example.touchbistro.io",
+				},
+				// The test server uses a self signed certificate
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+
+	results := deploy.CheckDeployed(context.Background(), services, nil)
+
+	assert.Len(t, results, 1)
+	assert.NoError(t, results[0].Err)
+}
+
+func TestCheckDeployedCABundle(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(250 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, gitsha)
+	}))
+	defer server.Close()
+
+	caFile, err := ioutil.TempFile("", "gehen-ca-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	err = pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	caFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	services := []*config.Service{
+		{
+			Name:   "example-production",
+			Gitsha: gitsha,
+			URL:    server.URL,
+			Check:  config.Check{CABundle: caFile.Name()},
+		},
+	}
+
+	results := deploy.CheckDeployed(context.Background(), services, nil)
+
+	assert.Len(t, results, 1)
+	assert.NoError(t, results[0].Err)
+}
+
+func TestCheckDeployedQuorum(t *testing.T) {
+	deploy.TimeoutDuration(1 * time.Second)
+	deploy.CheckIntervalDuration(100 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+
+	newServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, gitsha)
+	}))
+	defer newServer.Close()
+
+	oldServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, previousGitsha)
+	}))
+	defer oldServer.Close()
+
+	urls := []string{newServer.URL, newServer.URL, oldServer.URL}
+	tests := []struct {
+		name        string
+		quorum      int
+		expectedErr error
+	}{
+		{"all", 0, deploy.ErrTimedOut},
+		{"any", 1, nil},
+		{"2 of 3", 2, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services := []*config.Service{
+				{
+					Name:   "example-production",
+					Gitsha: gitsha,
+					URLs:   urls,
+					Quorum: tt.quorum,
+				},
+			}
+
+			results := deploy.CheckDeployed(context.Background(), services, nil)
+
+			assert.Len(t, results, 1)
+			assert.Equal(t, tt.expectedErr, results[0].Err)
+		})
+	}
+}
+
+func TestCheckDeployedSuccessThreshold(t *testing.T) {
+	deploy.TimeoutDuration(1 * time.Second)
+	deploy.CheckIntervalDuration(50 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+
+	var mu sync.Mutex
+	requests := 0
+	// Simulates a load balancer mixing old and new tasks
+	mixedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		if n%2 == 0 {
+			fmt.Fprint(w, previousGitsha)
+			return
+		}
+		fmt.Fprint(w, gitsha)
+	}))
+	defer mixedServer.Close()
+
+	newServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, gitsha)
+	}))
+	defer newServer.Close()
+
+	tests := []struct {
+		name        string
+		url         string
+		check       config.Check
+		expectedErr error
+	}{
+		{"threshold met", newServer.URL, config.Check{SuccessThreshold: 3}, nil},
+		{"threshold not met", mixedServer.URL, config.Check{SuccessThreshold: 3}, deploy.ErrTimedOut},
+		{"old version seen", mixedServer.URL, config.Check{NoOldVersionInLast: 4}, deploy.ErrTimedOut},
+		{"no old version seen", newServer.URL, config.Check{NoOldVersionInLast: 4}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services := []*config.Service{
+				{
+					Name:   "example-production",
+					Gitsha: gitsha,
+					URL:    tt.url,
+					Check:  tt.check,
+				},
+			}
+
+			results := deploy.CheckDeployed(context.Background(), services, nil)
+
+			assert.Len(t, results, 1)
+			assert.Equal(t, tt.expectedErr, results[0].Err)
+		})
+	}
+}
+
 func TestCheckDeployFailed(t *testing.T) {
 	deploy.TimeoutDuration(1 * time.Second)
 	deploy.CheckIntervalDuration(250 * time.Millisecond)
@@ -315,56 +805,268 @@ func TestCheckDeployFailed(t *testing.T) {
 		},
 	}
 
-	results := deploy.CheckDeployed(services)
+	results := deploy.CheckDeployed(context.Background(), services, nil)
 
 	assert.ElementsMatch(t, expectedResults, results)
 }
 
-func TestCheckDeployedSkip(t *testing.T) {
-	deploy.TimeoutDuration(3 * time.Second)
-	deploy.CheckIntervalDuration(250 * time.Millisecond)
+func TestCheckDeployedTCP(t *testing.T) {
+	deploy.TimeoutDuration(1 * time.Second)
+	deploy.CheckIntervalDuration(50 * time.Millisecond)
 
-	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
 
-	services := []*config.Service{
-		{
-			Name:   "example-production",
-			Gitsha: gitsha,
-		},
-		{
-			Name:   "example-staging",
-			Gitsha: gitsha,
-		},
-	}
+	// Reserve an address then close it so nothing is listening on it
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	closedListener.Close()
 
-	expectedResults := []deploy.Result{
+	services := []*config.Service{
 		{
-			Service: &config.Service{
-				Name:   "example-production",
-				Gitsha: gitsha,
-			},
-			Err: deploy.ErrNoDeployCheckURL,
+			Name:   "example-socket",
+			Gitsha: "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+			Check:  config.Check{TCP: listener.Addr().String()},
 		},
 		{
-			Service: &config.Service{
-				Name:   "example-staging",
-				Gitsha: gitsha,
-			},
-			Err: deploy.ErrNoDeployCheckURL,
+			Name:   "example-closed",
+			Gitsha: "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+			Check:  config.Check{TCP: closedListener.Addr().String()},
 		},
 	}
 
-	results := deploy.CheckDeployed(services)
+	results := deploy.CheckDeployed(context.Background(), services, nil)
 
-	assert.ElementsMatch(t, expectedResults, results)
+	assert.Len(t, results, 2)
+	for _, r := range results {
+		switch r.Service.Name {
+		case "example-socket":
+			assert.NoError(t, r.Err)
+		case "example-closed":
+			assert.Equal(t, deploy.ErrTimedOut, r.Err)
+		}
+	}
 }
 
-func TestCheckDrain(t *testing.T) {
-	deploy.TimeoutDuration(3 * time.Second)
-	deploy.CheckIntervalDuration(250 * time.Millisecond)
+func TestCheckDeployedGRPC(t *testing.T) {
+	deploy.TimeoutDuration(1 * time.Second)
+	deploy.CheckIntervalDuration(50 * time.Millisecond)
 
 	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
-	services := []*config.Service{
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := grpc.SetHeader(ctx, metadata.Pairs("x-version", gitsha)); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}))
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("example.v1.Example", grpc_health_v1.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus("example.v1.Stopped", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	grpc_health_v1.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	tests := []struct {
+		name        string
+		check       config.GRPCCheck
+		expectedErr error
+	}{
+		{"serving", config.GRPCCheck{Service: "example.v1.Example", VersionMetadata: "x-version"}, nil},
+		{"not serving", config.GRPCCheck{Service: "example.v1.Stopped", VersionMetadata: "x-version"}, deploy.ErrTimedOut},
+		{"missing metadata", config.GRPCCheck{Service: "example.v1.Example", VersionMetadata: "x-commit"}, deploy.ErrTimedOut},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := tt.check
+			check.Address = listener.Addr().String()
+			services := []*config.Service{
+				{
+					Name:   "example-grpc",
+					Gitsha: gitsha,
+					Check:  config.Check{GRPC: &check},
+				},
+			}
+
+			results := deploy.CheckDeployed(context.Background(), services, nil)
+
+			assert.Len(t, results, 1)
+			assert.Equal(t, tt.expectedErr, results[0].Err)
+		})
+	}
+}
+
+func TestCheckDeployedCommand(t *testing.T) {
+	deploy.TimeoutDuration(1 * time.Second)
+	deploy.CheckIntervalDuration(50 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+
+	tests := []struct {
+		name        string
+		command     []string
+		expectedErr error
+	}{
+		{"env var", []string{"sh", "-c", "echo version $GEHEN_GITSHA"}, nil},
+		{"old version", []string{"echo", previousGitsha}, deploy.ErrTimedOut},
+		{"failed", []string{"sh", "-c", "echo " + gitsha + "; exit 1"}, deploy.ErrTimedOut},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services := []*config.Service{
+				{
+					Name:   "example-worker",
+					Gitsha: gitsha,
+					Check:  config.Check{Command: tt.command},
+				},
+			}
+
+			results := deploy.CheckDeployed(context.Background(), services, nil)
+
+			assert.Len(t, results, 1)
+			assert.Equal(t, tt.expectedErr, results[0].Err)
+		})
+	}
+}
+
+func TestCheckDeployedServiceTimeout(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(250 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := fmt.Sprintf("example-service:api-%s", previousGitsha)
+		w.Header().Add("Server", v)
+		fmt.Fprint(w, "OK")
+	}))
+	defer server.Close()
+
+	services := []*config.Service{
+		{
+			Name:                  "example-production",
+			Gitsha:                gitsha,
+			URL:                   server.URL,
+			TimeoutDuration:       500 * time.Millisecond,
+			CheckIntervalDuration: 100 * time.Millisecond,
+		},
+	}
+
+	start := time.Now()
+	results := deploy.CheckDeployed(context.Background(), services, nil)
+
+	assert.Less(t, int64(time.Since(start)), int64(3*time.Second))
+	assert.Len(t, results, 1)
+	assert.Equal(t, deploy.ErrTimedOut, results[0].Err)
+}
+
+func TestCheckDeployedCancelled(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(100 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := fmt.Sprintf("example-service:api-%s", previousGitsha)
+		w.Header().Add("Server", v)
+		fmt.Fprint(w, "OK")
+	}))
+	defer server.Close()
+
+	services := []*config.Service{
+		{
+			Name:   "example-production",
+			Gitsha: gitsha,
+			URL:    server.URL,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	results := deploy.CheckDeployed(ctx, services, nil)
+
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+	assert.Len(t, results, 1)
+	assert.Equal(t, deploy.ErrCancelled, results[0].Err)
+}
+
+func TestCheckDeployedECSTasks(t *testing.T) {
+	deploy.TimeoutDuration(1 * time.Second)
+	deploy.CheckIntervalDuration(100 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+	cluster := "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster"
+
+	mockClient := awsecs.NewMockECSClient(
+		[]string{
+			"example-production",
+			"example-staging",
+			"example-unhealthy",
+		},
+		"example-service",
+		previousGitsha,
+	)
+	for _, name := range []string{"example-production", "example-staging", "example-unhealthy"} {
+		mockClient.AddMockRevision(name, gitsha)
+	}
+	mockClient.CreateMockTasks(cluster, "example-production", "arn:aws:ecs:us-east-1:123456:task-definition/example-production:2", true, 2)
+	mockClient.CreateMockTasks(cluster, "example-staging", "arn:aws:ecs:us-east-1:123456:task-definition/example-staging:2", true, 2)
+	// An old task is still running
+	mockClient.CreateMockTasks(cluster, "example-staging", "arn:aws:ecs:us-east-1:123456:task-definition/example-staging:1", true, 1)
+	mockClient.CreateMockTasks(cluster, "example-unhealthy", "arn:aws:ecs:us-east-1:123456:task-definition/example-unhealthy:2", false, 2)
+
+	services := []*config.Service{
+		{
+			Name:              "example-production",
+			Gitsha:            gitsha,
+			Cluster:           cluster,
+			TaskDefinitionARN: "arn:aws:ecs:us-east-1:123456:task-definition/example-production:2",
+		},
+		{
+			Name:              "example-staging",
+			Gitsha:            gitsha,
+			Cluster:           cluster,
+			TaskDefinitionARN: "arn:aws:ecs:us-east-1:123456:task-definition/example-staging:2",
+		},
+		{
+			Name:              "example-unhealthy",
+			Gitsha:            gitsha,
+			Cluster:           cluster,
+			TaskDefinitionARN: "arn:aws:ecs:us-east-1:123456:task-definition/example-unhealthy:2",
+		},
+	}
+
+	results := deploy.CheckDeployed(context.Background(), services, mockClient)
+
+	assert.Len(t, results, 3)
+	for _, r := range results {
+		switch r.Service.Name {
+		case "example-production":
+			assert.NoError(t, r.Err)
+		case "example-staging", "example-unhealthy":
+			assert.Equal(t, deploy.ErrTimedOut, r.Err)
+		}
+	}
+}
+
+func TestCheckDrain(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(250 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	services := []*config.Service{
 		{
 			Name:              "example-production",
 			Gitsha:            gitsha,
@@ -427,7 +1129,7 @@ func TestCheckDrain(t *testing.T) {
 		},
 	}
 
-	results := deploy.CheckDrained(context.Background(), services, mockClient)
+	results := deploy.CheckDrained(context.Background(), services, mockClient, awsecs.NewMockELBClient(), awsecs.NewMockCodeDeployClient(mockClient))
 
 	assert.ElementsMatch(t, expectedResults, results)
 }
@@ -479,7 +1181,7 @@ func TestCheckDrainFailed(t *testing.T) {
 	mockClient.SetServiceStatus("example-production", "ACTIVE")
 	mockClient.SetServiceStatus("example-staging", "ACTIVE")
 
-	results := deploy.CheckDrained(context.Background(), services, mockClient)
+	results := deploy.CheckDrained(context.Background(), services, mockClient, awsecs.NewMockELBClient(), awsecs.NewMockCodeDeployClient(mockClient))
 	var gotServices []*config.Service
 	var errs []error
 	for _, r := range results {
@@ -496,6 +1198,91 @@ func TestCheckDrainFailed(t *testing.T) {
 	}
 }
 
+func TestCheckDrainFailedManyTasks(t *testing.T) {
+	deploy.TimeoutDuration(1 * time.Second)
+	deploy.CheckIntervalDuration(250 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	cluster := "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster"
+	taskDef := "arn:aws:ecs:us-east-1:123456:task-definition/example-production:1"
+	services := []*config.Service{
+		{
+			Name:              "example-production",
+			Gitsha:            gitsha,
+			Cluster:           cluster,
+			TaskDefinitionARN: taskDef,
+		},
+	}
+
+	mockClient := awsecs.NewMockECSClient([]string{"example-production"}, "example-service", gitsha)
+	// More tasks than fit in one page of ListTasks or one DescribeTasks call,
+	// the unhealthy one is only in the second page
+	mockClient.CreateMockTasks(cluster, "example-production", taskDef, true, 139)
+	mockClient.CreateMockTasks(cluster, "example-production", taskDef, false, 1)
+	mockClient.SetServiceStatus("example-production", "ACTIVE")
+
+	results := deploy.CheckDrained(context.Background(), services, mockClient, awsecs.NewMockELBClient(), awsecs.NewMockCodeDeployClient(mockClient))
+
+	assert.Len(t, results, 1)
+	assert.True(t, errors.Is(results[0].Err, awsecs.ErrHealthcheckFailed), "expected ErrHealthcheckFailed, got %v", results[0].Err)
+}
+
+func TestCheckDrainAWSErrors(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(250 * time.Millisecond)
+
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{
+			name: "throttled",
+			err:  &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"},
+		},
+		{
+			name: "server error",
+			err: &smithyhttp.ResponseError{
+				Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}},
+				Err:      errors.New("service unavailable"),
+			},
+		},
+		{
+			name:    "permanent",
+			err:     &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized to perform: ecs:DescribeServices"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+			cluster := "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster"
+			taskDef := "arn:aws:ecs:us-east-1:123456:task-definition/example-production:1"
+			service := &config.Service{
+				Name:              "example-production",
+				Gitsha:            gitsha,
+				Cluster:           cluster,
+				TaskDefinitionARN: taskDef,
+			}
+
+			mockClient := awsecs.NewMockECSClient([]string{"example-production"}, "example-service", gitsha)
+			mockClient.CreateMockTasks(cluster, "example-production", taskDef, true, 2)
+			mockClient.FailDescribeServices("example-production", tt.err, 3)
+
+			results := deploy.CheckDrained(context.Background(), []*config.Service{service}, mockClient, awsecs.NewMockELBClient(), awsecs.NewMockCodeDeployClient(mockClient))
+
+			assert.Len(t, results, 1)
+			if tt.wantErr {
+				assert.True(t, errors.Is(results[0].Err, tt.err), "expected %v, got %v", tt.err, results[0].Err)
+				return
+			}
+			// Retryable errors are tried again on the next check instead of failing the service
+			assert.NoError(t, results[0].Err)
+		})
+	}
+}
+
 func TestCheckDrainTimedOut(t *testing.T) {
 	deploy.TimeoutDuration(1 * time.Second)
 	deploy.CheckIntervalDuration(250 * time.Millisecond)
@@ -552,11 +1339,789 @@ func TestCheckDrainTimedOut(t *testing.T) {
 		},
 	}
 
-	results := deploy.CheckDrained(context.Background(), services, mockClient)
+	results := deploy.CheckDrained(context.Background(), services, mockClient, awsecs.NewMockELBClient(), awsecs.NewMockCodeDeployClient(mockClient))
 
 	assert.ElementsMatch(t, expectedResults, results)
 }
 
+func TestCheckDrainCancelled(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(100 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	services := []*config.Service{
+		{
+			Name:              "example-production",
+			Gitsha:            gitsha,
+			Cluster:           "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+			TaskDefinitionARN: "arn:aws:ecs:us-east-1:123456:task-definition/example-production:1",
+		},
+	}
+
+	mockClient := awsecs.NewMockECSClient(
+		[]string{"example-production"},
+		"example-service",
+		gitsha,
+	)
+
+	// Never drains
+	mockClient.SetServiceStatus("example-production", "ACTIVE")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+
+	start := time.Now()
+	results := deploy.CheckDrained(ctx, services, mockClient, awsecs.NewMockELBClient(), awsecs.NewMockCodeDeployClient(mockClient))
+
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+	assert.Len(t, results, 1)
+	assert.Equal(t, deploy.ErrCancelled, results[0].Err)
+}
+
+func TestCheckDrainTargetHealth(t *testing.T) {
+	deploy.TimeoutDuration(1 * time.Second)
+	deploy.CheckIntervalDuration(100 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	cluster := "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster"
+	taskDefARN := "arn:aws:ecs:us-east-1:123456:task-definition/example-production:1"
+	targetGroupARN := "arn:aws:elasticloadbalancing:us-east-1:123456:targetgroup/example-production/abc123"
+	oldTaskIP := "10.1.0.1"
+
+	tests := []struct {
+		name        string
+		setup       func(elbClient *awsecs.MockELBClient, newTaskIPs []string)
+		expectedErr error
+	}{
+		{
+			"drained",
+			func(elbClient *awsecs.MockELBClient, newTaskIPs []string) {
+				elbClient.SetTargetHealth(targetGroupARN, oldTaskIP, 8080, elbtypes.TargetHealthStateEnumDraining)
+				elbClient.DeregisterTarget(targetGroupARN, oldTaskIP, 8080)
+			},
+			nil,
+		},
+		{
+			"old target draining",
+			func(elbClient *awsecs.MockELBClient, newTaskIPs []string) {
+				elbClient.SetTargetHealth(targetGroupARN, oldTaskIP, 8080, elbtypes.TargetHealthStateEnumDraining)
+			},
+			deploy.ErrTimedOut,
+		},
+		{
+			"new target unhealthy",
+			func(elbClient *awsecs.MockELBClient, newTaskIPs []string) {
+				elbClient.SetTargetHealth(targetGroupARN, newTaskIPs[0], 8080, elbtypes.TargetHealthStateEnumUnhealthy)
+			},
+			deploy.ErrTimedOut,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services := []*config.Service{
+				{
+					Name:              "example-production",
+					Gitsha:            gitsha,
+					Cluster:           cluster,
+					TaskDefinitionARN: taskDefARN,
+				},
+			}
+
+			mockClient := awsecs.NewMockECSClient([]string{"example-production"}, "example-service", gitsha)
+			mockClient.AddMockLoadBalancer("example-production", targetGroupARN, 8080)
+			mockClient.CreateMockTasks(cluster, "example-production", taskDefARN, true, 2)
+			newTaskIPs := mockClient.TaskIPs("example-production", taskDefARN)
+
+			elbClient := awsecs.NewMockELBClient()
+			for _, ip := range newTaskIPs {
+				elbClient.SetTargetHealth(targetGroupARN, ip, 8080, elbtypes.TargetHealthStateEnumHealthy)
+			}
+			// Other ports of the tasks are ignored
+			elbClient.SetTargetHealth(targetGroupARN, newTaskIPs[0], 9090, elbtypes.TargetHealthStateEnumUnhealthy)
+			tt.setup(elbClient, newTaskIPs)
+
+			results := deploy.CheckDrained(context.Background(), services, mockClient, elbClient, awsecs.NewMockCodeDeployClient(mockClient))
+
+			assert.Len(t, results, 1)
+			assert.Equal(t, tt.expectedErr, results[0].Err)
+		})
+	}
+}
+
+func TestCheckDrainTargetHealthBridge(t *testing.T) {
+	deploy.TimeoutDuration(1 * time.Second)
+	deploy.CheckIntervalDuration(100 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	cluster := "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster"
+	taskDefARN := "arn:aws:ecs:us-east-1:123456:task-definition/example-production:1"
+	targetGroupARN := "arn:aws:elasticloadbalancing:us-east-1:123456:targetgroup/example-production/abc123"
+	instanceID := "i-0123456789abcdef0"
+
+	tests := []struct {
+		name        string
+		setup       func(elbClient *awsecs.MockELBClient, newHostPorts []int32)
+		expectedErr error
+	}{
+		{
+			"drained",
+			func(elbClient *awsecs.MockELBClient, newHostPorts []int32) {},
+			nil,
+		},
+		{
+			"old target draining",
+			func(elbClient *awsecs.MockELBClient, newHostPorts []int32) {
+				// An old task on the same instance with a different host port
+				elbClient.SetTargetHealth(targetGroupARN, instanceID, 32700, elbtypes.TargetHealthStateEnumDraining)
+			},
+			deploy.ErrTimedOut,
+		},
+		{
+			"new target unhealthy",
+			func(elbClient *awsecs.MockELBClient, newHostPorts []int32) {
+				elbClient.SetTargetHealth(targetGroupARN, instanceID, newHostPorts[0], elbtypes.TargetHealthStateEnumUnhealthy)
+			},
+			deploy.ErrTimedOut,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services := []*config.Service{
+				{
+					Name:              "example-production",
+					Gitsha:            gitsha,
+					Cluster:           cluster,
+					TaskDefinitionARN: taskDefARN,
+				},
+			}
+
+			mockClient := awsecs.NewMockECSClient([]string{"example-production"}, "example-service", gitsha)
+			mockClient.AddMockLoadBalancer("example-production", targetGroupARN, 8080)
+			mockClient.CreateMockBridgeTasks(cluster, "example-production", taskDefARN, instanceID, true, 2)
+			newHostPorts := mockClient.TaskHostPorts("example-production", taskDefARN)
+
+			elbClient := awsecs.NewMockELBClient()
+			for _, port := range newHostPorts {
+				elbClient.SetTargetHealth(targetGroupARN, instanceID, port, elbtypes.TargetHealthStateEnumHealthy)
+			}
+			tt.setup(elbClient, newHostPorts)
+
+			results := deploy.CheckDrained(context.Background(), services, mockClient, elbClient, awsecs.NewMockCodeDeployClient(mockClient))
+
+			assert.Len(t, results, 1)
+			assert.Equal(t, tt.expectedErr, results[0].Err)
+		})
+	}
+}
+
+func TestCheckDrainCircuitBreaker(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(250 * time.Millisecond)
+
+	tests := []struct {
+		name            string
+		rollback        bool
+		expectedUpdates int
+	}{
+		{"ECS rolled back", true, 1},
+		{"no rollback", false, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+			previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+			service := &config.Service{
+				Name:    "example-production",
+				Gitsha:  gitsha,
+				Cluster: "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+			}
+
+			mockClient := awsecs.NewMockECSClient([]string{"example-production"}, "example-service", previousGitsha)
+			cdClient := awsecs.NewMockCodeDeployClient(mockClient)
+			deployResults := deploy.Deploy(context.Background(), []*config.Service{service}, mockClient, cdClient)
+			assert.NoError(t, deployResults[0].Err)
+			mockClient.FailDeployment("example-production", "tasks failed to start", tt.rollback)
+
+			start := time.Now()
+			drainResults := deploy.CheckDrained(context.Background(), []*config.Service{service}, mockClient, awsecs.NewMockELBClient(), cdClient)
+			assert.True(t, errors.Is(drainResults[0].Err, awsecs.ErrDeploymentFailed))
+			assert.Contains(t, drainResults[0].Err.Error(), "tasks failed to start")
+			// Fails immediately instead of timing out
+			assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+			rollbackResults := deploy.Rollback(context.Background(), []*config.Service{service}, mockClient, cdClient)
+			assert.NoError(t, rollbackResults[0].Err)
+			assert.Equal(t, tt.expectedUpdates, mockClient.UpdateCount("example-production"))
+
+			drainResults = deploy.CheckDrained(context.Background(), []*config.Service{service}, mockClient, awsecs.NewMockELBClient(), cdClient)
+			assert.NoError(t, drainResults[0].Err)
+		})
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+	cluster := "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster"
+	newTaskDef := "arn:aws:ecs:us-east-1:123456:task-definition/example-production:2"
+	service := &config.Service{
+		Name:              "example-production",
+		Gitsha:            gitsha,
+		Region:            "ca-central-1",
+		Cluster:           cluster,
+		TaskDefinitionARN: newTaskDef,
+		LogLines:          10,
+	}
+
+	mockClient := awsecs.NewMockECSClient([]string{"example-production"}, "example-service", previousGitsha)
+	mockClient.AddMockRevision("example-production", gitsha)
+	mockClient.CreateMockTasks(cluster, "example-production", "arn:aws:ecs:us-east-1:123456:task-definition/example-production:1", true, 2)
+	mockClient.CreateMockTasks(cluster, "example-production", newTaskDef, false, 2)
+	mockClient.StopMockTasks("example-production", newTaskDef, "Essential container in task exited", 137)
+	mockClient.CreateMockTasks(cluster, "example-production", newTaskDef, false, 1)
+	for i := 0; i < 7; i++ {
+		mockClient.AddServiceEvent("example-production", fmt.Sprintf("has started 1 tasks: (task %d)", i))
+	}
+	logsClient := awsecs.NewMockLogsClient()
+	stoppedIDs := mockClient.MockTaskIDs("example-production", newTaskDef, ecstypes.DesiredStatusStopped)
+	for _, id := range stoppedIDs {
+		for i := 0; i < 25; i++ {
+			logsClient.AddLogLines("/ecs/example-production", "ecs/example-service/"+id, fmt.Sprintf("line %d\n", i))
+		}
+	}
+	unhealthyIDs := mockClient.MockTaskIDs("example-production", newTaskDef, ecstypes.DesiredStatusRunning)
+
+	results := deploy.Diagnose(context.Background(), []*config.Service{service}, mockClient, logsClient)
+
+	assert.Len(t, results, 1)
+	assert.NoError(t, results[0].Err)
+	diagnosis := results[0].Diagnosis
+	assert.Len(t, diagnosis.StoppedTasks, 2)
+	for _, task := range diagnosis.StoppedTasks {
+		assert.Equal(t, "Essential container in task exited", task.StoppedReason)
+		assert.NotContains(t, task.ID, "/")
+		assert.Len(t, task.Containers, 1)
+		assert.Equal(t, int32(137), *task.Containers[0].ExitCode)
+	}
+	// Only the latest events, newest first
+	assert.Len(t, diagnosis.Events, 5)
+	assert.Equal(t, "(service example-production) has started 1 tasks: (task 6)", diagnosis.Events[0].Message)
+	assert.Equal(t, unhealthyIDs, diagnosis.UnhealthyTasks)
+
+	// Logs of the unhealthy task first, its stream doesn't exist
+	assert.Len(t, diagnosis.Logs, 3)
+	assert.Equal(t, unhealthyIDs[0], diagnosis.Logs[0].TaskID)
+	assert.Error(t, diagnosis.Logs[0].Err)
+	for _, l := range diagnosis.Logs[1:] {
+		assert.Contains(t, stoppedIDs, l.TaskID)
+		assert.Equal(t, "example-service", l.Container)
+		assert.Equal(t, "/ecs/example-production", l.LogGroup)
+		assert.Equal(t, "ecs/example-service/"+l.TaskID, l.LogStream)
+		assert.NoError(t, l.Err)
+		// Only the last lines, oldest first
+		assert.Len(t, l.Lines, 10)
+		assert.Equal(t, "line 15", l.Lines[0])
+		assert.Equal(t, "line 24", l.Lines[9])
+	}
+	// The logs are read from the region set in the task definition, not the region of the service
+	for _, l := range diagnosis.Logs {
+		assert.Equal(t, "us-east-1", l.Region)
+	}
+	assert.Equal(t, []string{"us-east-1", "us-east-1", "us-east-1"}, logsClient.Regions())
+
+	// Without LogLines the default number of lines is shown
+	service.LogLines = 0
+	results = deploy.Diagnose(context.Background(), []*config.Service{service}, mockClient, logsClient)
+	assert.NoError(t, results[0].Err)
+	for _, l := range results[0].Diagnosis.Logs[1:] {
+		assert.Len(t, l.Lines, 20)
+		assert.Equal(t, "line 5", l.Lines[0])
+	}
+}
+
+func TestDeployCodeDeploy(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(250 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+	cluster := "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster"
+	service := &config.Service{
+		Name:    "example-production",
+		Gitsha:  gitsha,
+		Cluster: cluster,
+	}
+
+	mockClient := awsecs.NewMockECSClient([]string{"example-production"}, "example-service", previousGitsha)
+	mockClient.UseCodeDeploy("example-production", cluster)
+	cdClient := awsecs.NewMockCodeDeployClient(mockClient)
+
+	deployResults := deploy.Deploy(context.Background(), []*config.Service{service}, mockClient, cdClient)
+	assert.NoError(t, deployResults[0].Err)
+	assert.NotEmpty(t, service.DeploymentID)
+
+	drainResults := deploy.CheckDrained(context.Background(), []*config.Service{service}, mockClient, awsecs.NewMockELBClient(), cdClient)
+	assert.NoError(t, drainResults[0].Err)
+	assert.Len(t, mockClient.TaskIPs("example-production", "arn:aws:ecs:us-east-1:123456:task-definition/example-production:2"), 2)
+}
+
+func TestCheckDrainCodeDeployFailed(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(250 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+	cluster := "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster"
+	service := &config.Service{
+		Name:    "example-production",
+		Gitsha:  gitsha,
+		Cluster: cluster,
+	}
+
+	mockClient := awsecs.NewMockECSClient([]string{"example-production"}, "example-service", previousGitsha)
+	mockClient.UseCodeDeploy("example-production", cluster)
+	mockClient.CreateMockTasks(cluster, "example-production", "arn:aws:ecs:us-east-1:123456:task-definition/example-production:1", true, 2)
+	cdClient := awsecs.NewMockCodeDeployClient(mockClient)
+	cdClient.SetDeploymentStatus(cdtypes.DeploymentStatusFailed)
+
+	deployResults := deploy.Deploy(context.Background(), []*config.Service{service}, mockClient, cdClient)
+	assert.NoError(t, deployResults[0].Err)
+	failedDeploymentID := service.DeploymentID
+
+	drainResults := deploy.CheckDrained(context.Background(), []*config.Service{service}, mockClient, awsecs.NewMockELBClient(), cdClient)
+	assert.True(t, errors.Is(drainResults[0].Err, awsecs.ErrCodeDeployFailed))
+
+	// CodeDeploy already rolled back so no new deployment is created
+	rollbackResults := deploy.Rollback(context.Background(), []*config.Service{service}, mockClient, cdClient)
+	assert.NoError(t, rollbackResults[0].Err)
+	assert.NotEqual(t, failedDeploymentID, service.DeploymentID)
+	assert.Equal(t, "arn:aws:ecs:us-east-1:123456:task-definition/example-production:1", service.TaskDefinitionARN)
+
+	drainResults = deploy.CheckDrained(context.Background(), []*config.Service{service}, mockClient, awsecs.NewMockELBClient(), cdClient)
+	assert.NoError(t, drainResults[0].Err)
+}
+
+func TestDeployStages(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(250 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+	stagingService := &config.Service{
+		Name:    "example-staging",
+		Gitsha:  gitsha,
+		Cluster: "arn:aws:ecs:us-east-1:123456:cluster/non-prod-cluster",
+		Stage:   "staging",
+	}
+	productionService := &config.Service{
+		Name:    "example-production",
+		Gitsha:  gitsha,
+		Cluster: "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+		Stage:   "production",
+	}
+	stages := []*config.Stage{
+		{Name: "staging", Services: []*config.Service{stagingService}},
+		{Name: "production", Services: []*config.Service{productionService}},
+	}
+
+	mockClient := awsecs.NewMockECSClient(
+		[]string{
+			"example-production",
+			"example-staging",
+		},
+		"example-service",
+		previousGitsha,
+	)
+
+	results := deploy.DeployStages(context.Background(), context.Background(), stages, mockClients{mockClient, awsecs.NewMockELBClient(), awsecs.NewMockCloudWatchClient(nil), awsecs.NewMockCodeDeployClient(mockClient)})
+
+	assert.Len(t, results, 2)
+	for _, r := range results {
+		assert.NoError(t, r.Err)
+	}
+	assert.ElementsMatch(t, []*config.Service{stagingService, productionService}, deploy.DeployedServices(results))
+	assert.Equal(t, "arn:aws:ecs:us-east-1:123456:task-definition/example-production:2", productionService.TaskDefinitionARN)
+}
+
+func TestDeployStagesUpdateStrategyNone(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(250 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	cluster := "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster"
+	// Not deployed by gehen and has no URL so its tasks in ECS are checked
+	service := &config.Service{
+		Name:           "example-production",
+		Gitsha:         gitsha,
+		Cluster:        cluster,
+		UpdateStrategy: config.UpdateStrategyNone,
+		BakeDuration:   500 * time.Millisecond,
+	}
+	stages := []*config.Stage{
+		{Services: []*config.Service{service}},
+	}
+
+	mockClient := awsecs.NewMockECSClient([]string{"example-production"}, "example-service", gitsha)
+	mockClient.CreateMockTasks(cluster, "example-production", "arn:aws:ecs:us-east-1:123456:task-definition/example-production:1", true, 2)
+
+	results := deploy.DeployStages(context.Background(), context.Background(), stages, mockClients{mockClient, awsecs.NewMockELBClient(), awsecs.NewMockCloudWatchClient(nil), awsecs.NewMockCodeDeployClient(mockClient)})
+
+	assert.Len(t, results, 1)
+	assert.NoError(t, results[0].Err)
+	assert.Empty(t, deploy.DeployedServices(results))
+	assert.Empty(t, service.TaskDefinitionARN)
+	assert.Equal(t, 0, mockClient.UpdateCount("example-production"))
+}
+
+func TestDeployStagesFailed(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(250 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+	stagingService := &config.Service{
+		Name:    "example-staging",
+		Gitsha:  gitsha,
+		Cluster: "arn:aws:ecs:us-east-1:123456:cluster/non-prod-cluster",
+		Stage:   "staging",
+	}
+	missingService := &config.Service{
+		Name:    "example-missing",
+		Gitsha:  gitsha,
+		Cluster: "arn:aws:ecs:us-east-1:123456:cluster/non-prod-cluster",
+		Stage:   "staging",
+	}
+	productionService := &config.Service{
+		Name:    "example-production",
+		Gitsha:  gitsha,
+		Cluster: "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+		Stage:   "production",
+	}
+	stages := []*config.Stage{
+		{Name: "staging", Services: []*config.Service{stagingService, missingService}},
+		{Name: "production", Services: []*config.Service{productionService}},
+	}
+
+	mockClient := awsecs.NewMockECSClient(
+		[]string{
+			"example-production",
+			"example-staging",
+		},
+		"example-service",
+		previousGitsha,
+	)
+
+	results := deploy.DeployStages(context.Background(), context.Background(), stages, mockClients{mockClient, awsecs.NewMockELBClient(), awsecs.NewMockCloudWatchClient(nil), awsecs.NewMockCodeDeployClient(mockClient)})
+
+	// Production should never have been touched
+	assert.Len(t, results, 1)
+	assert.Equal(t, deploy.ErrDeployFailed, results[0].Err)
+	assert.Nil(t, results[0].CheckDeployedResults)
+	assert.Equal(t, []*config.Service{stagingService}, deploy.DeployedServices(results))
+	assert.Empty(t, productionService.TaskDefinitionARN)
+}
+
+func TestBake(t *testing.T) {
+	deploy.CheckIntervalDuration(50 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, gitsha)
+	}))
+	defer server.Close()
+
+	cwClient := awsecs.NewMockCloudWatchClient([]string{
+		"example-production-5xx",
+		"example-production-latency",
+		"example-staging-5xx",
+	})
+	// Already alarming before the deploy started so it is ignored
+	cwClient.SetAlarmState("example-production-latency", cwtypes.StateValueAlarm)
+	since := time.Now()
+
+	services := []*config.Service{
+		{
+			Name:         "example-production",
+			Gitsha:       gitsha,
+			URL:          server.URL,
+			Alarms:       []string{"example-production-5xx", "example-production-latency"},
+			BakeDuration: 300 * time.Millisecond,
+		},
+		{
+			Name:         "example-staging",
+			Gitsha:       gitsha,
+			URL:          server.URL,
+			Alarms:       []string{"example-staging-5xx"},
+			BakeDuration: 5 * time.Second,
+		},
+		{
+			Name:         "example-missing",
+			Gitsha:       gitsha,
+			URL:          server.URL,
+			Alarms:       []string{"example-missing-5xx"},
+			BakeDuration: 300 * time.Millisecond,
+		},
+		{
+			Name:   "example-worker",
+			Gitsha: gitsha,
+		},
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cwClient.SetAlarmState("example-staging-5xx", cwtypes.StateValueAlarm)
+	}()
+
+	start := time.Now()
+	results := deploy.Bake(context.Background(), services, since, awsecs.NewMockECSClient(nil, "", ""), cwClient)
+
+	// The staging alarm should stop the bake early
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Len(t, results, 4)
+	for _, r := range results {
+		switch r.Service.Name {
+		case "example-production", "example-worker":
+			assert.NoError(t, r.Err)
+		case "example-staging":
+			assert.True(t, errors.Is(r.Err, awsecs.ErrAlarm))
+		case "example-missing":
+			assert.Error(t, r.Err)
+			assert.False(t, errors.Is(r.Err, awsecs.ErrAlarm))
+		}
+	}
+}
+
+func TestBakeDegraded(t *testing.T) {
+	deploy.CheckIntervalDuration(50 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+	cluster := "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster"
+
+	newServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, gitsha)
+	}))
+	defer newServer.Close()
+
+	var mu sync.Mutex
+	requests := 0
+	// Starts serving the old version after a few requests, like an ECS rollback
+	flakyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		if n > 3 {
+			fmt.Fprint(w, previousGitsha)
+			return
+		}
+		fmt.Fprint(w, gitsha)
+	}))
+	defer flakyServer.Close()
+
+	badGatewayRequests := 0
+	// The load balancer fails some requests but the service keeps serving the new version
+	badGatewayServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		badGatewayRequests++
+		n := badGatewayRequests
+		mu.Unlock()
+		if n%2 == 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, gitsha)
+	}))
+	defer badGatewayServer.Close()
+
+	mockClient := awsecs.NewMockECSClient([]string{"example-production", "example-unhealthy"}, "example-service", gitsha)
+	mockClient.CreateMockTasks(cluster, "example-production", "arn:aws:ecs:us-east-1:123456:task-definition/example-production:1", true, 2)
+	mockClient.CreateMockTasks(cluster, "example-unhealthy", "arn:aws:ecs:us-east-1:123456:task-definition/example-unhealthy:1", false, 1)
+
+	services := []*config.Service{
+		{
+			Name:              "example-production",
+			Gitsha:            gitsha,
+			Cluster:           cluster,
+			URL:               newServer.URL,
+			TaskDefinitionARN: "arn:aws:ecs:us-east-1:123456:task-definition/example-production:1",
+			BakeDuration:      300 * time.Millisecond,
+		},
+		{
+			Name:         "example-flaky",
+			Gitsha:       gitsha,
+			Cluster:      cluster,
+			URL:          flakyServer.URL,
+			Check:        config.Check{SuccessThreshold: 2},
+			BakeDuration: 5 * time.Second,
+		},
+		{
+			Name:              "example-unhealthy",
+			Gitsha:            gitsha,
+			Cluster:           cluster,
+			URL:               newServer.URL,
+			TaskDefinitionARN: "arn:aws:ecs:us-east-1:123456:task-definition/example-unhealthy:1",
+			BakeDuration:      5 * time.Second,
+		},
+		{
+			Name:         "example-bad-gateway",
+			Gitsha:       gitsha,
+			Cluster:      cluster,
+			URL:          badGatewayServer.URL,
+			BakeDuration: 300 * time.Millisecond,
+		},
+	}
+
+	results := deploy.Bake(context.Background(), services, time.Now(), mockClient, awsecs.NewMockCloudWatchClient(nil))
+
+	assert.Len(t, results, 4)
+	for _, r := range results {
+		switch r.Service.Name {
+		case "example-production":
+			assert.NoError(t, r.Err)
+		case "example-flaky":
+			assert.True(t, errors.Is(r.Err, deploy.ErrDegraded))
+			// One failure is tolerated with a threshold of 2
+			mu.Lock()
+			assert.Equal(t, 5, requests)
+			mu.Unlock()
+		case "example-unhealthy":
+			assert.True(t, errors.Is(r.Err, awsecs.ErrHealthcheckFailed))
+		case "example-bad-gateway":
+			// Failed requests don't show another version
+			assert.NoError(t, r.Err)
+		}
+	}
+}
+
+func TestDeployStagesBakeFailed(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(100 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+	stagingService := &config.Service{
+		Name:         "example-staging",
+		Gitsha:       gitsha,
+		Cluster:      "arn:aws:ecs:us-east-1:123456:cluster/non-prod-cluster",
+		Stage:        "staging",
+		Alarms:       []string{"example-staging-5xx"},
+		BakeDuration: 5 * time.Second,
+	}
+	productionService := &config.Service{
+		Name:    "example-production",
+		Gitsha:  gitsha,
+		Cluster: "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+		Stage:   "production",
+	}
+	stages := []*config.Stage{
+		{Name: "staging", Services: []*config.Service{stagingService}},
+		{Name: "production", Services: []*config.Service{productionService}},
+	}
+
+	mockClient := awsecs.NewMockECSClient(
+		[]string{
+			"example-production",
+			"example-staging",
+		},
+		"example-service",
+		previousGitsha,
+	)
+	cwClient := awsecs.NewMockCloudWatchClient([]string{"example-staging-5xx"})
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		cwClient.SetAlarmState("example-staging-5xx", cwtypes.StateValueAlarm)
+	}()
+
+	results := deploy.DeployStages(context.Background(), context.Background(), stages, mockClients{mockClient, awsecs.NewMockELBClient(), cwClient, awsecs.NewMockCodeDeployClient(mockClient)})
+
+	assert.Len(t, results, 1)
+	assert.Equal(t, deploy.ErrBakeFailed, results[0].Err)
+	assert.Len(t, results[0].BakeResults, 1)
+	assert.Equal(t, []*config.Service{stagingService}, deploy.DeployedServices(results))
+	assert.Equal(t, []*config.Service{stagingService}, deploy.FailedServices(results[0]))
+	assert.Empty(t, productionService.TaskDefinitionARN)
+}
+
+func TestDeployStagesCanaryFailed(t *testing.T) {
+	deploy.TimeoutDuration(3 * time.Second)
+	deploy.CheckIntervalDuration(100 * time.Millisecond)
+
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
+	canaryService := &config.Service{
+		Name:         "example-production-canary",
+		Gitsha:       gitsha,
+		Cluster:      "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+		Stage:        "production",
+		Alarms:       []string{"example-production-canary-5xx"},
+		BakeDuration: 5 * time.Second,
+	}
+	productionService := &config.Service{
+		Name:    "example-production",
+		Gitsha:  gitsha,
+		Cluster: "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+		Stage:   "production",
+		Canary:  canaryService,
+	}
+	stages := []*config.Stage{
+		{Name: "production-canary", Services: []*config.Service{canaryService}, Canary: true},
+		{Name: "production", Services: []*config.Service{productionService}},
+	}
+
+	mockClient := awsecs.NewMockECSClient(
+		[]string{
+			"example-production",
+			"example-production-canary",
+		},
+		"example-service",
+		previousGitsha,
+	)
+	cwClient := awsecs.NewMockCloudWatchClient([]string{"example-production-canary-5xx"})
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		cwClient.SetAlarmState("example-production-canary-5xx", cwtypes.StateValueAlarm)
+	}()
+
+	results := deploy.DeployStages(context.Background(), context.Background(), stages, mockClients{mockClient, awsecs.NewMockELBClient(), cwClient, awsecs.NewMockCodeDeployClient(mockClient)})
+
+	assert.Len(t, results, 1)
+	assert.Equal(t, deploy.ErrBakeFailed, results[0].Err)
+	// Only the canary needs to be rolled back
+	assert.Equal(t, []*config.Service{canaryService}, deploy.DeployedServices(results))
+	assert.Empty(t, productionService.TaskDefinitionARN)
+}
+
+func TestDeployStagesCancelled(t *testing.T) {
+	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	productionService := &config.Service{
+		Name:    "example-production",
+		Gitsha:  gitsha,
+		Cluster: "arn:aws:ecs:us-east-1:123456:cluster/prod-cluster",
+	}
+	stages := []*config.Stage{
+		{Services: []*config.Service{productionService}},
+	}
+
+	mockClient := awsecs.NewMockECSClient(
+		[]string{"example-production"},
+		"example-service",
+		"b6589fc6ab0dc82cf12099d1c2d40ab994e8410c",
+	)
+
+	stop, cancel := context.WithCancel(context.Background())
+	cancel()
+	results := deploy.DeployStages(context.Background(), stop, stages, mockClients{mockClient, awsecs.NewMockELBClient(), awsecs.NewMockCloudWatchClient(nil), awsecs.NewMockCodeDeployClient(mockClient)})
+
+	assert.Len(t, results, 1)
+	assert.Equal(t, deploy.ErrCancelled, results[0].Err)
+	assert.Empty(t, deploy.DeployedServices(results))
+	assert.Empty(t, productionService.TaskDefinitionARN)
+}
+
 func TestUpdateScheduledTasks(t *testing.T) {
 	gitsha := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
 	previousGitsha := "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"
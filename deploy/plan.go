@@ -0,0 +1,68 @@
+package deploy
+
+import (
+	"context"
+
+	"github.com/TouchBistro/gehen/awsecs"
+	"github.com/TouchBistro/gehen/config"
+)
+
+// PlanResult represents the result of planning a deploy for a service.
+// If planning failed Err will be non-nil.
+type PlanResult struct {
+	Service *config.Service
+	Plan    awsecs.TaskDefPlan
+	Err     error
+}
+
+// ScheduledTaskPlanResult represents the result of planning an update for a scheduled task.
+// If planning failed Err will be non-nil.
+type ScheduledTaskPlanResult struct {
+	Task *config.ScheduledTask
+	Plan awsecs.TaskDefPlan
+	Err  error
+}
+
+// Plan determines the changes Deploy would make to the given services without modifying anything.
+func Plan(ctx context.Context, services []*config.Service, ecsClients awsecs.ECSClientProvider) []PlanResult {
+	resultChan := make(chan PlanResult)
+
+	for _, s := range services {
+		go func(service *config.Service) {
+			plan, err := awsecs.PlanDeploy(ctx, service, ecsClients.ECSClient(service.Region, service.Role))
+			resultChan <- PlanResult{service, plan, err}
+		}(s)
+	}
+
+	results := make([]PlanResult, len(services))
+	for i := 0; i < len(services); i++ {
+		results[i] = <-resultChan
+	}
+
+	return results
+}
+
+// PlanScheduledTasks determines the changes UpdateScheduledTasks would make to the given
+// scheduled tasks without modifying anything.
+func PlanScheduledTasks(ctx context.Context, tasks []*config.ScheduledTask, ebClients awsecs.EBClientProvider, ecsClients awsecs.ECSClientProvider) []ScheduledTaskPlanResult {
+	resultChan := make(chan ScheduledTaskPlanResult)
+
+	for _, t := range tasks {
+		go func(task *config.ScheduledTask) {
+			plan, err := awsecs.PlanScheduledTask(
+				ctx,
+				task,
+				ebClients.EBClient(task.Region, task.Role),
+				ecsClients.ECSClient(task.Region, task.Role),
+			)
+			resultChan <- ScheduledTaskPlanResult{task, plan, err}
+		}(t)
+	}
+
+	results := make([]ScheduledTaskPlanResult, len(tasks))
+	for i := 0; i < len(tasks); i++ {
+		results[i] = <-resultChan
+	}
+
+	return results
+}
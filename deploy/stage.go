@@ -0,0 +1,204 @@
+package deploy
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/TouchBistro/gehen/awsecs"
+	"github.com/TouchBistro/gehen/config"
+	"github.com/TouchBistro/goutils/color"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrDeployFailed is set on a StageResult if a new deployment could not be created for a service.
+	ErrDeployFailed = errors.New("deploy: failed to create new deployments")
+	// ErrCheckDeployedFailed is set on a StageResult if a service failed the deploy check.
+	ErrCheckDeployedFailed = errors.New("deploy: failed to check for newly deployed versions")
+	// ErrCheckDrainedFailed is set on a StageResult if a service failed the drain check.
+	ErrCheckDrainedFailed = errors.New("deploy: failed to check if old versions drained")
+	// ErrBakeFailed is set on a StageResult if a service degraded or triggered an alarm while baking.
+	ErrBakeFailed = errors.New("deploy: services degraded after deploying")
+)
+
+// StageResult represents the result of deploying a stage.
+// If the stage failed Err will be non-nil and contain the step that failed.
+// If the drain check timed out Err will be ErrTimedOut.
+// If the deploy was cancelled Err will be ErrCancelled.
+type StageResult struct {
+	Stage *config.Stage
+	// Services that had new deployments created. These are the services
+	// that need to be rolled back if the deploy fails.
+	Deployed []*config.Service
+	// Results of each step. A step that was not run will have nil results.
+	DeployResults        []Result
+	CheckDeployedResults []Result
+	CheckDrainedResults  []Result
+	BakeResults          []Result
+	Err                  error
+}
+
+// Clients provides the AWS clients needed to deploy stages.
+type Clients interface {
+	awsecs.ECSClientProvider
+	awsecs.ELBClientProvider
+	awsecs.CWClientProvider
+	awsecs.CDClientProvider
+}
+
+// DeployStages deploys the given stages in order. A stage is deployed, checked, drained
+// and baked before moving onto the next one. If a stage fails no further stages are deployed,
+// so a failed canary stage stops the services it is a canary for from being deployed.
+// Services with the UpdateStrategyNone update strategy are checked but not deployed.
+//
+// ctx is used for each phase of the deploy. Once stop is done no new phase is started
+// and the stage result will have Err set to ErrCancelled. Passing the same context for
+// both stops the current phase immediately, passing a context that is never cancelled
+// for ctx allows the current phase to finish first.
+func DeployStages(ctx, stop context.Context, stages []*config.Stage, clients Clients) []StageResult {
+	results := make([]StageResult, 0, len(stages))
+	for _, stage := range stages {
+		if stop.Err() != nil {
+			results = append(results, StageResult{Stage: stage, Err: ErrCancelled})
+			break
+		}
+		if stage.Name != "" {
+			log.Printf("Deploying stage %s\n", color.Cyan(stage.Name))
+		}
+
+		result := deployStage(ctx, stop, stage, clients)
+		results = append(results, result)
+		if result.Err != nil {
+			if stage.Canary {
+				log.Printf("Canary stage %s failed, not deploying the services it is a canary for\n", color.Cyan(stage.Name))
+			} else if stage.Name != "" {
+				log.Printf("Stage %s failed, not deploying any further stages\n", color.Cyan(stage.Name))
+			}
+			break
+		}
+	}
+	return results
+}
+
+// DeployedServices returns all services that had new deployments created in the given stages.
+func DeployedServices(results []StageResult) []*config.Service {
+	var services []*config.Service
+	for _, r := range results {
+		services = append(services, r.Deployed...)
+	}
+	return services
+}
+
+// FailedServices returns the services that failed a step of the stage, excluding ones that were cancelled.
+func FailedServices(result StageResult) []*config.Service {
+	var services []*config.Service
+	for _, results := range [][]Result{result.CheckDeployedResults, result.CheckDrainedResults, result.BakeResults} {
+		for _, r := range results {
+			if r.Err != nil && r.Err != ErrCancelled {
+				services = append(services, r.Service)
+			}
+		}
+	}
+	return services
+}
+
+func deployStage(ctx, stop context.Context, stage *config.Stage, clients Clients) StageResult {
+	result := StageResult{Stage: stage}
+	// Alarms that went off before this are not caused by the deploy
+	startedAt := time.Now()
+
+	var toDeploy []*config.Service
+	for _, s := range stage.Services {
+		if s.UpdateStrategy != config.UpdateStrategyNone {
+			toDeploy = append(toDeploy, s)
+		}
+	}
+
+	result.DeployResults = Deploy(ctx, toDeploy, clients, clients)
+	for _, r := range result.DeployResults {
+		if r.Err != nil {
+			result.Err = ErrDeployFailed
+			continue
+		}
+		result.Deployed = append(result.Deployed, r.Service)
+	}
+	if result.Err = checkCancelled(ctx, stop, result.Err); result.Err != nil {
+		return result
+	}
+
+	result.CheckDeployedResults = CheckDeployed(ctx, stage.Services, clients)
+	for _, r := range result.CheckDeployedResults {
+		if r.Err != nil {
+			result.Err = ErrCheckDeployedFailed
+		}
+	}
+	if result.Err = checkCancelled(ctx, stop, result.Err); result.Err != nil {
+		return result
+	}
+
+	result.CheckDrainedResults = CheckDrained(ctx, stage.Services, clients, clients, clients)
+	timedOut := false
+	for _, r := range result.CheckDrainedResults {
+		if r.Err == nil {
+			continue
+		}
+		if errors.Is(r.Err, ErrTimedOut) {
+			timedOut = true
+			continue
+		}
+		result.Err = ErrCheckDrainedFailed
+	}
+	// A failure is more important than a time out
+	if result.Err == nil && timedOut {
+		result.Err = ErrTimedOut
+	}
+	if !needsBake(stage.Services) {
+		// The stage is finished so only an interrupted drain check counts as cancelled
+		if ctx.Err() != nil {
+			result.Err = ErrCancelled
+		}
+		return result
+	}
+	if result.Err = checkCancelled(ctx, stop, result.Err); result.Err != nil {
+		return result
+	}
+
+	result.BakeResults = Bake(ctx, stage.Services, startedAt, clients, clients)
+	for _, r := range result.BakeResults {
+		if r.Err != nil {
+			result.Err = ErrBakeFailed
+		}
+	}
+	// The stage is finished so only an interrupted bake counts as cancelled
+	if ctx.Err() != nil {
+		result.Err = ErrCancelled
+	}
+	return result
+}
+
+// needsBake reports whether any of the services have a bake duration.
+func needsBake(services []*config.Service) bool {
+	for _, s := range services {
+		if s.BakeDuration != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCancelled returns the error for a phase of a stage that returned err.
+// If ctx was cancelled the phase was interrupted so its results can't be trusted.
+// Otherwise a failure in the phase takes precedence over stop being done.
+func checkCancelled(ctx, stop context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ErrCancelled
+	}
+	if err != nil {
+		return err
+	}
+	if stop.Err() != nil {
+		return ErrCancelled
+	}
+	return nil
+}
@@ -9,13 +9,19 @@ require (
 	github.com/aws/aws-sdk-go-v2 v1.9.0
 	github.com/aws/aws-sdk-go-v2/config v1.8.1
 	github.com/aws/aws-sdk-go-v2/credentials v1.4.1
+	github.com/aws/aws-sdk-go-v2/service/cloudwatch v1.8.0
+	github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs v1.7.0
+	github.com/aws/aws-sdk-go-v2/service/codedeploy v1.6.0
 	github.com/aws/aws-sdk-go-v2/service/ecs v1.9.0
+	github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2 v1.7.0
 	github.com/aws/aws-sdk-go-v2/service/eventbridge v1.7.0
 	github.com/aws/aws-sdk-go-v2/service/sts v1.7.0
+	github.com/aws/smithy-go v1.8.0
 	github.com/getsentry/sentry-go v0.11.0
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/objx v0.3.0 // indirect
 	github.com/stretchr/testify v1.7.0
 	golang.org/x/sys v0.0.0-20210423082822-04245dca01da // indirect
+	google.golang.org/grpc v1.40.0
 	gopkg.in/yaml.v2 v2.4.0
 )
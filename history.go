@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/TouchBistro/gehen/awsecs"
+	"github.com/TouchBistro/goutils/color"
+	"github.com/TouchBistro/goutils/fatal"
+)
+
+func runHistory(args []string) {
+	fs, cf := newFlagSet("history")
+	var (
+		limit       int
+		serviceName string
+	)
+	fs.IntVar(&limit, "limit", 10, "The number of revisions to show for each service")
+	fs.StringVar(&serviceName, "service", "", "Only show the history of the service with this name")
+	parseFlags(fs, args)
+
+	if limit < 1 {
+		fatal.Exit("limit must be at least 1")
+	}
+
+	parsedConfig := readConfig(cf.configPath, "")
+	services := filterServices(parsedConfig.Services, serviceName)
+	if len(services) == 0 {
+		fatal.Exitf("No service named %s in gehen.yml", serviceName)
+	}
+
+	ctx, stopSignals := signalContext()
+	defer stopSignals()
+	clients := newClients(ctx, parsedConfig, cf)
+
+	failed := false
+	for _, s := range services {
+		ecsClient := clients.ECSClient(s.Region, s.Role)
+		status, err := awsecs.GetServiceStatus(ctx, s, ecsClient)
+		if err != nil {
+			failed = true
+			log.Printf("Failed to get status of %s", color.Cyan(s.Name))
+			log.Printf("Error: %v", err)
+			continue
+		}
+
+		revisions, err := awsecs.ListRevisions(ctx, status.TaskDefinition.ARN, limit, ecsClient)
+		if err != nil {
+			failed = true
+			log.Printf("Failed to get task definition revisions of %s", color.Cyan(s.Name))
+			log.Printf("Error: %v", err)
+			continue
+		}
+
+		fmt.Printf("Service %s\n", color.Cyan(s.Name))
+		for _, r := range revisions {
+			current := ""
+			if r.ARN == status.TaskDefinition.ARN {
+				current = color.Green(" (current)")
+			}
+			fmt.Printf("  %s:%d %s%s\n", r.Family, r.Revision, color.Magenta(r.Gitsha(s.Containers)), current)
+			printContainers(r, s.Containers)
+		}
+		fmt.Println()
+	}
+
+	if failed {
+		fatal.Exit(color.Red("Failed to get the history of some services"))
+	}
+}
@@ -6,20 +6,16 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"time"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/TouchBistro/gehen/awsecs"
 	"github.com/TouchBistro/gehen/config"
-	"github.com/TouchBistro/gehen/deploy"
 	"github.com/TouchBistro/goutils/color"
 	"github.com/TouchBistro/goutils/fatal"
-	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
-	"github.com/aws/aws-sdk-go-v2/service/ecs"
-	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
-	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/getsentry/sentry-go"
 	"github.com/pkg/errors"
 )
@@ -27,18 +23,53 @@ import (
 // Set by goreleaser at build time
 var version string
 
-// Flag values
-var (
-	versionFlag bool
-	gitsha      string
-	configPath  string
-)
+// Region used if neither the --region flag or gehen.yml specify one
+const defaultRegion = "us-east-1"
 
 var (
 	useSentry    = false
 	statsdClient *statsd.Client
 )
 
+// command represents a gehen subcommand.
+type command struct {
+	name        string
+	description string
+	run         func(args []string)
+}
+
+var commands = []command{
+	{"deploy", "Deploy a new version of the services and scheduled tasks (default)", runDeploy},
+	{"plan", "Show the changes a deploy would make without deploying anything", runPlanCommand},
+	{"rollback", "Roll back the services to a previous task definition", runRollback},
+	{"status", "Show what is currently running for each service", runStatus},
+	{"history", "Show recent task definition revisions for each service", runHistory},
+	{"validate", "Validate the gehen.yml config file", runValidate},
+}
+
+// commonFlags are the flags shared by all commands.
+type commonFlags struct {
+	configPath string
+	region     string
+	maxRetries int
+}
+
+// newFlagSet creates a flag set for the named command with the common flags registered.
+func newFlagSet(name string) (*flag.FlagSet, *commonFlags) {
+	fs := flag.NewFlagSet("gehen "+name, flag.ExitOnError)
+	var cf commonFlags
+	fs.StringVar(&cf.configPath, "path", "gehen.yml", "The path to a gehen.yml config file")
+	fs.StringVar(&cf.region, "region", "", "The AWS region to use for scheduled tasks and services without a cluster ARN")
+	fs.IntVar(&cf.maxRetries, "max-retries", awsecs.DefaultMaxRetries, "How many times to retry AWS requests that fail because of throttling or AWS errors")
+	return fs, &cf
+}
+
+// parseFlags parses the command's args with its flag set.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	// Errors are handled by the flag package since it uses ExitOnError
+	_ = fs.Parse(args)
+}
+
 func sendStatsdEvents(services []*config.Service, eventTitle, eventText string) {
 	if statsdClient == nil {
 		return
@@ -79,158 +110,9 @@ func cleanup() {
 	}
 }
 
-func performRollback(ctx context.Context, services []*config.Service, scheduledTasks []*config.ScheduledTask, ebClient *eventbridge.Client, ecsClient *ecs.Client) {
-	rollbackResults := deploy.Rollback(ctx, services, ecsClient)
-	rollbackFailed := false
-
-	for _, result := range rollbackResults {
-		if result.Err == nil {
-			continue
-		}
-
-		rollbackFailed = true
-		log.Printf("Failed to create rollback to %s for %s", color.Magenta(result.Service.Gitsha), color.Cyan(result.Service.Name))
-		log.Printf("Error: %v", result.Err)
-
-		if useSentry {
-			sentry.CaptureException(result.Err)
-		}
-	}
-
-	if rollbackFailed {
-		fatal.Exit(color.Red("🚨 Failed to create rollbacks for services 🚨"))
-	}
-
-	sendStatsdEvents(services, "gehen.rollbacks.started", "Gehen started a rollback for service %s")
-
-	checkDeployedResults := deploy.CheckDeployed(services)
-	checkDeployedFailed := false
-
-	for _, result := range checkDeployedResults {
-		if result.Err == nil {
-			continue
-		}
-
-		checkDeployedFailed = true
-
-		if errors.Is(result.Err, deploy.ErrTimedOut) {
-			log.Printf(
-				"Timed out while checking for rolled back version %s of %s",
-				color.Magenta(result.Service.Gitsha),
-				color.Cyan(result.Service.Name),
-			)
-			continue
-		}
-
-		log.Printf(
-			"Failed to check for rolled back version %s of %s",
-			color.Magenta(result.Service.Gitsha),
-			color.Cyan(result.Service.Name),
-		)
-		log.Printf("Error: %v", result.Err)
-
-		if useSentry {
-			sentry.CaptureException(result.Err)
-		}
-	}
-
-	if checkDeployedFailed {
-		log.Println("This means your service failed to boot, or was unable to serve requests.")
-		log.Println("Your next step should be to check the logs for your service to find out why.")
-		fatal.Exit(color.Red("🚨 Failed to confirm services rolled back 🚨"))
-	}
-
-	sendStatsdEvents(services, "gehen.rollbacks.draining", "Gehen is checking for service rollback drain on %s")
-
-	checkDrainedResults := deploy.CheckDrained(ctx, services, ecsClient)
-	checkDrainedFailed := false
-
-	for _, result := range checkDrainedResults {
-		if result.Err == nil {
-			continue
-		}
-
-		checkDrainedFailed = true
-
-		if errors.Is(result.Err, deploy.ErrTimedOut) {
-			log.Printf("Timed out while waiting for new versions of %s to stop running", color.Cyan(result.Service.Name))
-			continue
-		}
-
-		log.Printf("Failed to check if new deployments of %s stopped", color.Cyan(result.Service.Name))
-		log.Printf("Error: %v", result.Err)
-
-		if useSentry {
-			sentry.CaptureException(result.Err)
-		}
-	}
-
-	if checkDrainedFailed {
-		log.Println(color.Yellow("The rollback was successful but some of the newer versions are still running"))
-		log.Println(color.Yellow("Please investigate why this is the case"))
-		// Do any cleanup manually since we are calling Exit and therefore defer won't run
-		cleanup()
-		// Exit code 2 to signal that this wasn't a successful deploy but it also wasn't a certain failure
-		os.Exit(2)
-	} else {
-		sendStatsdEvents(services, "gehen.rollbacks.completed", "Gehen successfully rolled back %s")
-	}
-
-	// Need to rollback scheduled tasks though since they will likely fail as well
-	// Also they would have inconsitent versions
-	rollbackScheduledTaskResults := deploy.RollbackScheduledTasks(ctx, scheduledTasks, ebClient, ecsClient)
-	rollbackScheduledTasksFailed := false
-
-	for _, result := range rollbackScheduledTaskResults {
-		if result.Err == nil {
-			continue
-		}
-
-		rollbackScheduledTasksFailed = true
-		log.Printf(
-			"Failed to roll back scheduled task %s to version %s",
-			color.Cyan(result.Task.Name),
-			color.Magenta(result.Task.PreviousGitsha),
-		)
-		log.Printf("Error: %v", result.Err)
-
-		if useSentry {
-			sentry.CaptureException(result.Err)
-		}
-	}
-
-	if rollbackScheduledTasksFailed {
-		fatal.Exit(color.Red("Failed to roll back some scheduled tasks"))
-	}
-
-	fatal.Exit(color.Yellow("🚨 Finished rolling back services 🚨"))
-}
-
-func main() {
-	// Handle flags
-	flag.BoolVar(&versionFlag, "version", false, "Prints the current gehen version")
-	flag.StringVar(&gitsha, "gitsha", "", "The gitsha of the version to be deployed")
-	flag.StringVar(&configPath, "path", "gehen.yml", "The path to a gehen.yml config file")
-
-	flag.Parse()
-
-	if versionFlag {
-		if version == "" {
-			version = "source"
-		}
-
-		fmt.Printf("gehen version %s\n", version)
-		os.Exit(0)
-	}
-
-	// gitsha is required
-	if gitsha == "" {
-		fatal.Exit("Must provide a gitsha")
-	}
-
-	// Initialize observability libraries
-	// Sentry for error tracking, Datadog StatsD for metrics
-
+// initObservability initializes the observability libraries.
+// Sentry for error tracking, Datadog StatsD for metrics
+func initObservability() {
 	if sentryDSN, ok := os.LookupEnv("SENTRY_DSN"); ok {
 		err := sentry.Init(sentry.ClientOptions{Dsn: sentryDSN})
 		if err != nil {
@@ -255,13 +137,12 @@ func main() {
 		statsdClient = client
 	}
 
-	defer cleanup()
-
 	// defers are skipped if Exit is used so we need to make sure flush still gets called
 	fatal.OnExit(cleanup)
+}
 
-	// gehen config, get and validate services
-
+// readConfig reads and validates the gehen config, exiting if it is invalid.
+func readConfig(configPath, gitsha string) config.ParsedConfig {
 	parsedConfig, err := config.Read(configPath, gitsha)
 	if err != nil {
 		fatal.ExitErr(err, "Failed to get services from config file")
@@ -270,180 +151,85 @@ func main() {
 	if len(parsedConfig.Services) == 0 && len(parsedConfig.ScheduledTasks) == 0 {
 		fatal.Exit("gehen.yml must contain at least one service or scheduled task")
 	}
+	return parsedConfig
+}
 
-	ctx := context.Background()
-	awscfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion("us-east-1"))
-	if err != nil {
-		fatal.ExitErr(err, "Failed to load AWS configuration")
-	}
-	if parsedConfig.Role != nil {
-		creds := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awscfg), parsedConfig.Role.ARN)
-		awscfg.Credentials = aws.NewCredentialsCache(creds)
-	}
-	ecsClient := ecs.NewFromConfig(awscfg)
-	ebClient := eventbridge.NewFromConfig(awscfg)
-
-	if parsedConfig.TimeoutMinutes != 0 {
-		deploy.TimeoutDuration(time.Duration(parsedConfig.TimeoutMinutes) * time.Minute)
+// newClients creates the AWS clients used to talk to ECS and EventBridge.
+// Clients are created per region and role so services in different regions and accounts
+// can be handled in the same run.
+func newClients(ctx context.Context, parsedConfig config.ParsedConfig, cf *commonFlags) *awsecs.Clients {
+	if cf.maxRetries < 0 {
+		fatal.Exit("--max-retries must not be negative")
 	}
 
-	// DEPLOYMENT ZONE //
-
-	// Update scheduled tasks first so if this fails we don't need to worry about rolling back services
-	updateScheduledTaskResults := deploy.UpdateScheduledTasks(ctx, parsedConfig.ScheduledTasks, ebClient, ecsClient)
-	updateScheduledTasksFailed := false
-
-	for _, result := range updateScheduledTaskResults {
-		if result.Err == nil {
-			continue
-		}
-
-		updateScheduledTasksFailed = true
-		log.Printf(
-			"Failed to update scheduled task %s to version %s",
-			color.Cyan(result.Task.Name),
-			color.Magenta(result.Task.Gitsha),
-		)
-		log.Printf("Error: %v", result.Err)
-
-		if useSentry {
-			sentry.CaptureException(result.Err)
-		}
+	// The --region flag takes precedence over the region in gehen.yml.
+	// Services will still use the region from their cluster ARN.
+	region := cf.region
+	if region == "" {
+		region = parsedConfig.Region
 	}
-
-	if updateScheduledTasksFailed {
-		fatal.Exit(color.Red("Failed to update some scheduled tasks"))
+	if region == "" {
+		region = defaultRegion
 	}
 
-	deployEnabled := parsedConfig.UpdateStrategy != config.UpdateStrategyNone
-	if deployEnabled {
-		deployResults := deploy.Deploy(ctx, parsedConfig.Services, ecsClient)
-		deployFailed := false
-		succeededServices := make([]*config.Service, 0)
-
-		for _, result := range deployResults {
-			if result.Err == nil {
-				succeededServices = append(succeededServices, result.Service)
-				continue
-			}
-
-			deployFailed = true
-			log.Printf(
-				"Failed to create new deployment to version %s for %s",
-				color.Magenta(result.Service.Gitsha),
-				color.Cyan(result.Service.Name),
-			)
-			log.Printf("Error: %v", result.Err)
-
-			if useSentry {
-				sentry.CaptureException(result.Err)
-			}
-		}
-
-		if deployFailed {
-			// If deploying failed we need to rollback all services that succeeded so that they aren't in inconsitent states
-			// If deploy failed that means the new version wasn't even registered on ECS so we only need to rollback ones that succeeded
-			log.Println(color.Red("Failed to create new versions of some services"))
-			log.Println(color.Yellow("Rolling back services that succeeded to prevent inconsistent states"))
-			performRollback(ctx, succeededServices, parsedConfig.ScheduledTasks, ebClient, ecsClient)
-		}
-
-		sendStatsdEvents(parsedConfig.Services, "gehen.deploys.started", "Gehen started a deploy for service %s")
-	}
-
-	checkDeployedResults := deploy.CheckDeployed(parsedConfig.Services)
-	checkDeployedFailed := false
-
-	for _, result := range checkDeployedResults {
-		if result.Err == nil || result.Err == deploy.ErrNoDeployCheckURL {
-			continue
-		}
-
-		checkDeployedFailed = true
-
-		if errors.Is(result.Err, deploy.ErrTimedOut) {
-			log.Printf(
-				"Timed out while checking for deployed version %s of %s",
-				color.Magenta(result.Service.Gitsha),
-				color.Cyan(result.Service.Name),
-			)
-			continue
-		}
-
-		log.Printf(
-			"Failed to check for deployed version %s of %s",
-			color.Magenta(result.Service.Gitsha),
-			color.Cyan(result.Service.Name),
-		)
-		log.Printf("Error: %v", result.Err)
-
-		if useSentry {
-			sentry.CaptureException(result.Err)
-		}
+	awscfg, err := awsconfig.LoadDefaultConfig(
+		ctx,
+		awsconfig.WithRegion(region),
+		awsconfig.WithRetryer(awsecs.NewRetryer(cf.maxRetries)),
+	)
+	if err != nil {
+		fatal.ExitErr(err, "Failed to load AWS configuration")
 	}
+	return awsecs.NewClients(awscfg)
+}
 
-	if checkDeployedFailed {
-		// If check deployment failed we need to roll everything back
-		// Services that timed out are likely stuck in a death loop
-		log.Println(color.Red("Some services failed deployment"))
-		log.Println("This means your service failed to boot, or was unable to serve requests.")
-		log.Println("Your next step should be to check the logs for your service to find out why.")
-
-		if !deployEnabled {
-			fatal.Exit("❌ Deployment failed")
-		}
+// signalContext returns a context that is cancelled when SIGINT or SIGTERM is received.
+// After the first signal the default behaviour is restored so a second one exits immediately.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Println(color.Yellow(fmt.Sprintf("Received %s, cancelling. Send it again to exit immediately", sig)))
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return ctx, cancel
+}
 
-		log.Println(color.Yellow("Rolling all services back to the previous version"))
-		performRollback(ctx, parsedConfig.Services, parsedConfig.ScheduledTasks, ebClient, ecsClient)
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: gehen <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.description)
 	}
+	fmt.Fprintf(os.Stderr, "\nRun 'gehen <command> -h' for the flags of a command.\n")
+	fmt.Fprintf(os.Stderr, "If no command is given, deploy is used.\n")
+}
 
-	sendStatsdEvents(parsedConfig.Services, "gehen.deploys.draining", "Gehen is checking for service drain on %s")
-
-	checkDrainedResults := deploy.CheckDrained(ctx, parsedConfig.Services, ecsClient)
-	checkDrainedFailed := false
-	checkDrainTimedOut := false
-
-	for _, result := range checkDrainedResults {
-		if result.Err == nil {
-			continue
-		}
-
-		if errors.Is(result.Err, deploy.ErrTimedOut) {
-			log.Printf("Timed out while waiting for old versions of %s to stop running", color.Cyan(result.Service.Name))
-			checkDrainTimedOut = true
-			continue
-		}
-
-		checkDrainedFailed = true
-		if errors.Is(result.Err, awsecs.ErrHealthcheckFailed) {
-			log.Printf("Container health checks failed for %s", color.Cyan(result.Service.Name))
+func main() {
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		for _, c := range commands {
+			if c.name == args[0] {
+				c.run(args[1:])
+				return
+			}
 		}
 
-		log.Printf("Failed to check if old version of %s are gone", color.Cyan(result.Service.Name))
-		log.Printf("Error: %v", result.Err)
-
-		if useSentry {
-			sentry.CaptureException(result.Err)
+		if args[0] == "help" {
+			usage()
+			return
 		}
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+		usage()
+		os.Exit(1)
 	}
 
-	if checkDrainedFailed {
-		log.Println(color.Red("Some services failed to drain old versions"))
-		log.Println("This means the new version failed to boot, or was unable to serve requests.")
-		log.Println("Your next step should be to check the logs for your service to find out why.")
-		log.Println(color.Yellow("Rolling all services back to the previous version"))
-		performRollback(ctx, parsedConfig.Services, parsedConfig.ScheduledTasks, ebClient, ecsClient)
-	} else if checkDrainTimedOut {
-		log.Println(color.Yellow("Some services still have the old version running"))
-		log.Println(color.Yellow("This means there are two different versions of the same service in production"))
-		log.Println(color.Yellow("Please investigate why this is the case"))
-		// Do any cleanup manually since we are calling Exit and therefore defer won't run
-		cleanup()
-		// Exit code 2 to signal that this wasn't a successful deploy but it also wasn't a certain failure
-		os.Exit(2)
-	} else {
-		sendStatsdEvents(parsedConfig.Services, "gehen.deploys.completed", "Gehen successfully deployed %s")
-	}
-
-	log.Println(color.Green("🚀 Finished deploying all services 🚀"))
+	// Running gehen without a command is the same as 'gehen deploy'
+	runDeploy(args)
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/TouchBistro/gehen/awsecs"
+	"github.com/TouchBistro/gehen/config"
+	"github.com/TouchBistro/gehen/deploy"
+	"github.com/TouchBistro/goutils/color"
+	"github.com/TouchBistro/goutils/fatal"
+)
+
+func runPlanCommand(args []string) {
+	fs, cf := newFlagSet("plan")
+	var gitsha string
+	fs.StringVar(&gitsha, "gitsha", "", "The gitsha of the version to be deployed")
+	parseFlags(fs, args)
+
+	if gitsha == "" {
+		fatal.Exit("Must provide a gitsha")
+	}
+	plan(cf, gitsha)
+}
+
+// plan prints the changes a deploy of gitsha would make, exiting if planning failed.
+func plan(cf *commonFlags, gitsha string) {
+	parsedConfig := readConfig(cf.configPath, gitsha)
+	ctx, stopSignals := signalContext()
+	defer stopSignals()
+	clients := newClients(ctx, parsedConfig, cf)
+
+	if !runPlan(ctx, parsedConfig, clients) {
+		fatal.Exit(color.Red("Failed to plan some services or scheduled tasks"))
+	}
+}
+
+// runPlan prints the changes a deploy would make without modifying anything.
+// It returns false if planning failed for any service or scheduled task.
+func runPlan(ctx context.Context, parsedConfig config.ParsedConfig, clients *awsecs.Clients) bool {
+	ok := true
+
+	for _, result := range deploy.PlanScheduledTasks(ctx, parsedConfig.ScheduledTasks, clients, clients) {
+		if result.Err != nil {
+			ok = false
+			log.Printf("Failed to plan update of scheduled task %s", color.Cyan(result.Task.Name))
+			log.Printf("Error: %v", result.Err)
+			continue
+		}
+		printPlan("Scheduled task", result.Task.Name, result.Task.UpdateStrategy, result.Plan)
+	}
+
+	var services []*config.Service
+	for _, s := range parsedConfig.Services {
+		if s.UpdateStrategy == config.UpdateStrategyNone {
+			fmt.Printf("Service %s\n", color.Cyan(s.Name))
+			fmt.Printf("  => updateStrategy is none, the service will not be deployed\n\n")
+			continue
+		}
+		services = append(services, s)
+	}
+
+	for _, result := range deploy.Plan(ctx, services, clients) {
+		if result.Err != nil {
+			ok = false
+			log.Printf("Failed to plan deploy of service %s", color.Cyan(result.Service.Name))
+			log.Printf("Error: %v", result.Err)
+			continue
+		}
+		printPlan("Service", result.Service.Name, result.Service.UpdateStrategy, result.Plan)
+	}
+
+	return ok
+}
+
+// printPlan prints a readable diff of the task definition changes in plan.
+func printPlan(kind, name, updateStrategy string, plan awsecs.TaskDefPlan) {
+	fmt.Printf("%s %s\n", kind, color.Cyan(name))
+	fmt.Printf("  task definition: %s\n", plan.CurrentTaskDefinitionARN)
+	if plan.BaseTaskDefinitionARN != plan.CurrentTaskDefinitionARN {
+		fmt.Printf("  based on:        %s (updateStrategy %s)\n", plan.BaseTaskDefinitionARN, updateStrategy)
+	}
+
+	for _, c := range plan.Containers {
+		switch {
+		case c.Skipped:
+			fmt.Printf("  container %s (skipped, not listed in containers)\n", c.Name)
+			fmt.Printf("      image: %s\n", c.Image)
+		case c.Image == c.NewImage:
+			fmt.Printf("  container %s (unchanged)\n", c.Name)
+			fmt.Printf("      image: %s\n", c.Image)
+		default:
+			fmt.Printf("  container %s\n", c.Name)
+			fmt.Printf("    %s\n", color.Red("- image: "+c.Image))
+			fmt.Printf("    %s\n", color.Green("+ image: "+c.NewImage))
+		}
+	}
+
+	switch {
+	case plan.NewRevision:
+		fmt.Printf("  => A new task definition revision will be registered\n\n")
+	case updateStrategy == config.UpdateStrategyRedeploy:
+		fmt.Printf("  => No new revision, %s will be redeployed\n\n", plan.BaseTaskDefinitionARN)
+	default:
+		fmt.Printf("  => No new revision, images already use the given gitsha\n\n")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+
+	"github.com/TouchBistro/gehen/config"
+	"github.com/TouchBistro/gehen/deploy"
+	"github.com/TouchBistro/goutils/color"
+	"github.com/TouchBistro/goutils/fatal"
+	"github.com/getsentry/sentry-go"
+)
+
+func runRollback(args []string) {
+	fs, cf := newFlagSet("rollback")
+	var (
+		to           string
+		serviceName  string
+		maxRevisions int
+	)
+	fs.StringVar(&to, "to", "", "The gitsha or task definition (ARN or family:revision) to roll back to, defaults to the previous revision")
+	fs.StringVar(&serviceName, "service", "", "Only roll back the service with this name")
+	fs.IntVar(&maxRevisions, "max-revisions", 50, "The number of the newest task definition revisions to search when looking for the revision to roll back to")
+	parseFlags(fs, args)
+
+	if maxRevisions < 1 {
+		fatal.Exit("max-revisions must be at least 1")
+	}
+
+	initObservability()
+	defer cleanup()
+
+	// The gitsha isn't known until the revision is looked up
+	parsedConfig := readConfig(cf.configPath, "")
+	services := filterServices(parsedConfig.Services, serviceName)
+	if len(services) == 0 {
+		fatal.Exitf("No service named %s in gehen.yml", serviceName)
+	}
+
+	ctx, stopSignals := signalContext()
+	defer stopSignals()
+	clients := newClients(ctx, parsedConfig, cf)
+
+	failed := false
+	for _, result := range deploy.PrepareRollback(ctx, services, to, maxRevisions, clients) {
+		if result.Err == nil {
+			continue
+		}
+
+		failed = true
+		log.Printf("Failed to find the revision to roll back to for %s", color.Cyan(result.Service.Name))
+		log.Printf("Error: %v", result.Err)
+
+		if useSentry {
+			sentry.CaptureException(result.Err)
+		}
+	}
+	if failed {
+		fatal.Exit(color.Red("Failed to prepare rollback, no services were changed"))
+	}
+
+	for _, s := range services {
+		log.Printf(
+			"Rolling back %s from %s to %s",
+			color.Cyan(s.Name),
+			color.Magenta(s.TaskDefinitionARN),
+			color.Magenta(s.PreviousTaskDefinitionARN),
+		)
+	}
+	rollback(ctx, services, nil, clients)
+	log.Println(color.Green("Finished rolling back services"))
+}
+
+// filterServices returns the service with the given name, or all services if name is empty.
+func filterServices(services []*config.Service, name string) []*config.Service {
+	if name == "" {
+		return services
+	}
+
+	for _, s := range services {
+		if s.Name == name {
+			return []*config.Service{s}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/TouchBistro/gehen/awsecs"
+	"github.com/TouchBistro/goutils/color"
+	"github.com/TouchBistro/goutils/fatal"
+)
+
+func runStatus(args []string) {
+	fs, cf := newFlagSet("status")
+	parseFlags(fs, args)
+
+	parsedConfig := readConfig(cf.configPath, "")
+	ctx, stopSignals := signalContext()
+	defer stopSignals()
+	clients := newClients(ctx, parsedConfig, cf)
+
+	failed := false
+	for _, s := range parsedConfig.Services {
+		status, err := awsecs.GetServiceStatus(ctx, s, clients.ECSClient(s.Region, s.Role))
+		if err != nil {
+			failed = true
+			log.Printf("Failed to get status of %s", color.Cyan(s.Name))
+			log.Printf("Error: %v", err)
+			continue
+		}
+
+		fmt.Printf("Service %s\n", color.Cyan(s.Name))
+		fmt.Printf("  Task definition: %s\n", status.TaskDefinition.ARN)
+		printContainers(status.TaskDefinition, s.Containers)
+
+		fmt.Printf("  Deployments:\n")
+		for _, d := range status.Deployments {
+			fmt.Printf(
+				"    %s %s (desired %d, running %d, pending %d)\n",
+				d.Status,
+				d.TaskDefinitionARN,
+				d.DesiredCount,
+				d.RunningCount,
+				d.PendingCount,
+			)
+		}
+		fmt.Println()
+	}
+
+	if failed {
+		fatal.Exit(color.Red("Failed to get the status of some services"))
+	}
+}
+
+// printContainers prints the image of each container in the task definition.
+// Containers managed by gehen are highlighted.
+func printContainers(revision awsecs.TaskDefRevision, containers []string) {
+	for _, c := range revision.Containers {
+		if awsecs.UpdatesContainer(containers, c.Name) {
+			fmt.Printf("    %s: %s\n", c.Name, color.Magenta(c.Image))
+			continue
+		}
+		fmt.Printf("    %s: %s\n", c.Name, c.Image)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/TouchBistro/goutils/color"
+)
+
+func runValidate(args []string) {
+	fs, cf := newFlagSet("validate")
+	parseFlags(fs, args)
+
+	// readConfig exits if the config is invalid
+	parsedConfig := readConfig(cf.configPath, "")
+
+	for _, stage := range parsedConfig.Stages {
+		if stage.Canary {
+			fmt.Printf("Stage %s (canary)\n", color.Cyan(stage.Name))
+		} else if stage.Name != "" {
+			fmt.Printf("Stage %s\n", color.Cyan(stage.Name))
+		}
+		for _, s := range stage.Services {
+			fmt.Printf("  Service %s in %s (updateStrategy: %s)\n", color.Cyan(s.Name), s.Cluster, s.UpdateStrategy)
+		}
+	}
+	for _, t := range parsedConfig.ScheduledTasks {
+		fmt.Printf("  Scheduled task %s (updateStrategy: %s)\n", color.Cyan(t.Name), t.UpdateStrategy)
+	}
+
+	fmt.Println(color.Green(fmt.Sprintf("%s is valid", cf.configPath)))
+}